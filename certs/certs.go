@@ -1,6 +1,7 @@
 package certs
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -21,12 +22,19 @@ type certsClient struct {
 	lastRootCertificate     *certificate.Resource
 }
 
-func (c *certsClient) RequestCertificates() {
-	c.requestCertificate("wildcard")
-	c.requestCertificate("root")
+// RequestCertificates obtains or renews the certificates as needed. Work
+// that hasn't started yet is skipped once ctx is done.
+func (c *certsClient) RequestCertificates(ctx context.Context) {
+	c.requestCertificate(ctx, "wildcard")
+	c.requestCertificate(ctx, "root")
 }
 
-func (c *certsClient) requestCertificate(certType string) {
+func (c *certsClient) requestCertificate(ctx context.Context, certType string) {
+	if ctx.Err() != nil {
+		utils.Logger.Info().Str("certType", certType).Msg("Shutting down, skip certificate request")
+		return
+	}
+
 	config := utils.GetConfig()
 	var lastCertificate *certificate.Resource
 	var domains []string
@@ -54,12 +62,17 @@ func (c *certsClient) requestCertificate(certType string) {
 			return
 		}
 
-		c.renewCertificates()
+		c.renewCertificates(ctx)
 		return
 	}
 
 	cert, err := c.legoClient.Certificate.Obtain(certificate.ObtainRequest{Domains: domains, Bundle: true})
 	if err != nil {
+		if ctx.Err() != nil {
+			// the DNS server stopped answering the challenge
+			utils.Logger.Info().Err(err).Str("certType", certType).Msg("Shutting down, abort certificate request")
+			return
+		}
 		utils.Logger.Fatal().Err(err).Msg("Failed to obtain certificate from lego client")
 	}
 
@@ -73,18 +86,30 @@ func (c *certsClient) requestCertificate(certType string) {
 
 }
 
-func (c *certsClient) renewCertificates() {
+func (c *certsClient) renewCertificates(ctx context.Context) {
 	utils.Logger.Info().Msg("Renewing certificates")
 
 	wildcardCertificate, err := c.legoClient.Certificate.Renew(*c.lastWildcardCertificate, true, false, "")
 	if err != nil {
+		if ctx.Err() != nil {
+			utils.Logger.Info().Err(err).Msg("Shutting down, abort certificates renewal")
+			return
+		}
 		utils.Logger.Fatal().Err(err).Msg("Failed to renew wildcard certificate")
 	}
 	c.lastWildcardCertificate = wildcardCertificate
 	persistFiles(wildcardCertificate, "wildcard")
 
+	if ctx.Err() != nil {
+		utils.Logger.Info().Msg("Shutting down, skip root certificate renewal")
+		return
+	}
 	rootCertificate, err := c.legoClient.Certificate.Renew(*c.lastRootCertificate, true, false, "")
 	if err != nil {
+		if ctx.Err() != nil {
+			utils.Logger.Info().Err(err).Msg("Shutting down, abort certificates renewal")
+			return
+		}
 		utils.Logger.Fatal().Err(err).Msg("Failed to renew root certificate")
 	}
 	c.lastRootCertificate = rootCertificate
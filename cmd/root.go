@@ -1,14 +1,22 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/mail"
+	"net/netip"
 	"net/url"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/asaskevich/govalidator"
 	"github.com/go-acme/lego/v4/lego"
+	"github.com/miekg/dns"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"local-ip.sh/certs"
@@ -45,6 +53,53 @@ var command = &cobra.Command{
 		}
 		viper.Set("NameServers", nameservers)
 
+		if viper.GetString("secondaries") != "" {
+			secondaries := strings.Split(viper.GetString("secondaries"), ",")
+			for _, secondary := range secondaries {
+				host, _, err := net.SplitHostPort(secondary)
+				if err != nil {
+					host = secondary
+				}
+				if !govalidator.IsIP(host) {
+					utils.Logger.Fatal().Str("secondary", secondary).Msg("Invalid secondary name server")
+				}
+			}
+			if viper.GetString("tsig-key") == "" {
+				utils.Logger.Fatal().Msg("Zone transfers to secondaries require a TSIG key")
+			}
+			viper.Set("Secondaries", secondaries)
+		}
+
+		if viper.GetString("rrl-exempt") != "" {
+			exempt := strings.Split(viper.GetString("rrl-exempt"), ",")
+			for _, prefix := range exempt {
+				if _, err := netip.ParsePrefix(prefix); err != nil {
+					utils.Logger.Fatal().Err(err).Str("rrl-exempt", prefix).Msg("Invalid rate limiting exemption")
+				}
+			}
+			viper.Set("RRLExempt", exempt)
+		}
+
+		viper.Set("DnsListen", parseListenAddresses("dns-listen", viper.GetUint("dns-port")))
+		if viper.GetString("dns-tcp-listen") != "" {
+			viper.Set("DnsTcpListen", parseListenAddresses("dns-tcp-listen", viper.GetUint("dns-port")))
+		}
+		viper.Set("HttpListen", parseListenAddresses("http-listen", viper.GetUint("http-port")))
+		viper.Set("HttpsListen", parseListenAddresses("https-listen", viper.GetUint("https-port")))
+
+		viper.Set("TypeTTLs", parseTTLs("ttl-types", func(rrtype string) bool {
+			_, ok := dns.StringToType[strings.ToUpper(rrtype)]
+			return ok
+		}))
+		viper.Set("NameTTLs", parseTTLs("ttl-names", func(name string) bool {
+			return name == "@" || govalidator.IsDNSName(strings.TrimSuffix(name, "."))
+		}))
+
+		anyResponse := viper.GetString("any-response")
+		if anyResponse != xip.AnyResponseHinfo && anyResponse != xip.AnyResponseTCP {
+			utils.Logger.Fatal().Str("any-response", anyResponse).Msgf("Invalid ANY response, expected %s or %s", xip.AnyResponseHinfo, xip.AnyResponseTCP)
+		}
+
 		staging := viper.GetBool("staging")
 		var caDir string
 		if staging {
@@ -62,29 +117,102 @@ var command = &cobra.Command{
 		utils.InitConfig()
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		n := xip.NewXip()
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+		defer stop()
 
-		go func() {
+		n := xip.NewXip(xip.WithTLSCertificates(http.RootCertificate, http.WildcardCertificate))
+
+		var wg sync.WaitGroup
+		wg.Go(func() {
 			// try to obtain certificates once the DNS server is accepting requests
 			account := certs.LoadAccount()
+			if account.Registration != nil {
+				n.SetCAAAccountURI(account.Registration.URI)
+			}
 			certsClient := certs.NewCertsClient(n, account)
 
-			time.Sleep(5 * time.Second)
-			certsClient.RequestCertificates()
-
-			for {
+			for wait := 5 * time.Second; ; wait = 24 * time.Hour {
 				// afterwards, try to renew certificates once a day
-				time.Sleep(24 * time.Hour)
-				certsClient.RequestCertificates()
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+				certsClient.RequestCertificates(ctx)
 			}
-		}()
+		})
 
-		go http.ServeHttp()
+		wg.Go(func() { http.ServeHttp(ctx, n.DohHandler()) })
 
-		n.StartServer()
+		if metricsAddress := utils.GetConfig().MetricsAddress; metricsAddress != "" {
+			wg.Go(func() { n.ServeMetrics(ctx, metricsAddress) })
+		}
+
+		wg.Go(func() { n.WatchStaticRecords(ctx) })
+
+		if err := n.StartServer(ctx); err != nil {
+			utils.Logger.Fatal().Err(err).Msg("DNS server stopped")
+		}
+		stopped := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+			utils.Logger.Info().Msg("Shut down cleanly")
+		case <-time.After(xip.ShutdownTimeout):
+			// lego requests can't be cancelled, they'd only stop after their own timeouts
+			utils.Logger.Warn().Msg("Timed out waiting for certificate requests and servers to stop")
+		}
 	},
 }
 
+// parseTTLs parses the comma-separated key=duration pairs of a flag, such as
+// "TXT=1m,MX=1h", exiting on keys that isValidKey rejects.
+func parseTTLs(flag string, isValidKey func(string) bool) map[string]time.Duration {
+	ttls := map[string]time.Duration{}
+	if viper.GetString(flag) == "" {
+		return ttls
+	}
+
+	for _, pair := range strings.Split(viper.GetString(flag), ",") {
+		key, value, found := strings.Cut(pair, "=")
+		if !found || !isValidKey(key) {
+			utils.Logger.Fatal().Str(flag, pair).Msg("Invalid TTL")
+		}
+		ttl, err := time.ParseDuration(value)
+		if err != nil {
+			utils.Logger.Fatal().Err(err).Str(flag, pair).Msg("Invalid TTL")
+		}
+		ttls[key] = ttl
+	}
+
+	return ttls
+}
+
+// parseListenAddresses parses the comma-separated host:port addresses of a
+// flag, such as "192.0.2.1:53,[2001:db8::1]:53", exiting on invalid ones.
+// It defaults to every interface on port.
+func parseListenAddresses(flag string, port uint) []string {
+	if viper.GetString(flag) == "" {
+		return []string{net.JoinHostPort("", strconv.FormatUint(uint64(port), 10))}
+	}
+
+	addresses := strings.Split(viper.GetString(flag), ",")
+	for _, address := range addresses {
+		_, port, err := net.SplitHostPort(address)
+		if err != nil {
+			utils.Logger.Fatal().Err(err).Str(flag, address).Msg("Invalid listen address")
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			utils.Logger.Fatal().Err(err).Str(flag, address).Msg("Invalid listen address port")
+		}
+	}
+
+	return addresses
+}
+
 func Execute() {
 	command.Flags().String("log-file", utils.DefaultLogFile, "Path to log file")
 	viper.BindPFlag("log-file", command.Flags().Lookup("log-file"))
@@ -92,15 +220,147 @@ func Execute() {
 	command.Flags().Uint("dns-port", 53, "Port for the DNS server")
 	viper.BindPFlag("dns-port", command.Flags().Lookup("dns-port"))
 
+	command.Flags().String("dns-listen", "", "List of host:port addresses for the DNS server separated by commas, defaults to every interface on the DNS port")
+	viper.BindPFlag("dns-listen", command.Flags().Lookup("dns-listen"))
+
+	command.Flags().String("dns-tcp-listen", "", "List of host:port addresses for the DNS server over TCP separated by commas, defaults to the DNS listen addresses")
+	viper.BindPFlag("dns-tcp-listen", command.Flags().Lookup("dns-tcp-listen"))
+
+	command.Flags().Int("dns-sockets", 0, "Number of UDP and TCP sockets sharing the DNS port with SO_REUSEPORT, defaults to GOMAXPROCS")
+	viper.BindPFlag("dns-sockets", command.Flags().Lookup("dns-sockets"))
+
+	command.Flags().Uint16("edns-udp-size", 1232, "UDP payload size advertised to EDNS clients")
+	viper.BindPFlag("edns-udp-size", command.Flags().Lookup("edns-udp-size"))
+
 	command.Flags().Uint("http-port", 80, "Port for the HTTP server")
 	viper.BindPFlag("http-port", command.Flags().Lookup("http-port"))
 
+	command.Flags().String("http-listen", "", "List of host:port addresses for the HTTP server separated by commas, defaults to every interface on the HTTP port")
+	viper.BindPFlag("http-listen", command.Flags().Lookup("http-listen"))
+
 	command.Flags().Uint("https-port", 443, "Port for the HTTPS server")
 	viper.BindPFlag("https-port", command.Flags().Lookup("https-port"))
 
+	command.Flags().String("https-listen", "", "List of host:port addresses for the HTTPS server separated by commas, defaults to every interface on the HTTPS port")
+	viper.BindPFlag("https-listen", command.Flags().Lookup("https-listen"))
+
+	command.Flags().String("metrics-address", "", "Address to serve Prometheus metrics on, such as :9153, disabled by default")
+	viper.BindPFlag("metrics-address", command.Flags().Lookup("metrics-address"))
+
+	command.Flags().String("dnstap", "", "dnstap output of the queries and responses, unix:/path/to/socket or file:/path/to/file")
+	viper.BindPFlag("dnstap", command.Flags().Lookup("dnstap"))
+
+	command.Flags().Int("workers", 0, "Maximum number of DNS queries answered concurrently, defaults to 8 per CPU")
+	viper.BindPFlag("workers", command.Flags().Lookup("workers"))
+
+	command.Flags().Duration("query-timeout", 2*time.Second, "How long DNS queries can wait for a worker before being dropped")
+	viper.BindPFlag("query-timeout", command.Flags().Lookup("query-timeout"))
+
+	command.Flags().Bool("dot", false, "Enable to serve DNS over TLS with the obtained certificates")
+	viper.BindPFlag("dot", command.Flags().Lookup("dot"))
+
+	command.Flags().Uint("dot-port", 853, "Port for the DNS over TLS server")
+	viper.BindPFlag("dot-port", command.Flags().Lookup("dot-port"))
+
+	command.Flags().Bool("doq", false, "Enable to serve DNS over QUIC with the obtained certificates")
+	viper.BindPFlag("doq", command.Flags().Lookup("doq"))
+
+	command.Flags().Uint("doq-port", 853, "UDP port for the DNS over QUIC server")
+	viper.BindPFlag("doq-port", command.Flags().Lookup("doq-port"))
+
+	command.Flags().Int64("doq-max-streams", 100, "Maximum number of concurrent queries of each DNS over QUIC connection")
+	viper.BindPFlag("doq-max-streams", command.Flags().Lookup("doq-max-streams"))
+
 	command.Flags().Bool("staging", false, "Enable to use the Let's Encrypt staging environment to obtain certificates")
 	viper.BindPFlag("staging", command.Flags().Lookup("staging"))
 
+	command.Flags().String("zone-file", "", "Path to an RFC 1035 zone file holding the static records of the zone")
+	viper.BindPFlag("zone-file", command.Flags().Lookup("zone-file"))
+
+	command.Flags().Duration("ttl", 5*time.Minute, "Default TTL of the answers")
+	viper.BindPFlag("ttl", command.Flags().Lookup("ttl"))
+
+	command.Flags().Duration("ttl-synthesized", 0, "TTL of the A and AAAA answers derived from the queried name, defaults to the TTL of their type")
+	viper.BindPFlag("ttl-synthesized", command.Flags().Lookup("ttl-synthesized"))
+
+	command.Flags().String("ttl-types", "", "TTLs of the static records by type, such as TXT=1m,MX=1h")
+	viper.BindPFlag("ttl-types", command.Flags().Lookup("ttl-types"))
+
+	command.Flags().String("ttl-names", "", "TTLs of the static records by name relative to the domain, such as _acme-challenge=10s,@=1h")
+	viper.BindPFlag("ttl-names", command.Flags().Lookup("ttl-names"))
+
+	command.Flags().Duration("soa-refresh", 15*time.Minute, "Refresh timer of the SOA record")
+	viper.BindPFlag("soa-refresh", command.Flags().Lookup("soa-refresh"))
+
+	command.Flags().Duration("soa-retry", 15*time.Minute, "Retry timer of the SOA record")
+	viper.BindPFlag("soa-retry", command.Flags().Lookup("soa-retry"))
+
+	command.Flags().Duration("soa-expire", 30*time.Minute, "Expire timer of the SOA record")
+	viper.BindPFlag("soa-expire", command.Flags().Lookup("soa-expire"))
+
+	command.Flags().Duration("soa-minimum", 5*time.Minute, "Minimum field of the SOA record, how long resolvers cache negative answers")
+	viper.BindPFlag("soa-minimum", command.Flags().Lookup("soa-minimum"))
+
+	command.Flags().String("any-response", xip.AnyResponseHinfo, "How to answer ANY queries: \"hinfo\" for a minimal RFC 8482 answer, \"tcp\" to also send every record over TCP")
+	viper.BindPFlag("any-response", command.Flags().Lookup("any-response"))
+
+	command.Flags().Bool("caa", true, "Publish CAA records allowing only the ACME CA to issue certificates for the domain")
+	viper.BindPFlag("caa", command.Flags().Lookup("caa"))
+
+	command.Flags().String("caa-issuer", "", "Issuer domain name of the CAA records, guessed from the ACME directory by default")
+	viper.BindPFlag("caa-issuer", command.Flags().Lookup("caa-issuer"))
+
+	command.Flags().Bool("caa-account-uri", false, "Enable to restrict the CAA records to the registered ACME account")
+	viper.BindPFlag("caa-account-uri", command.Flags().Lookup("caa-account-uri"))
+
+	command.Flags().String("secondaries", "", "List of secondary nameservers allowed to transfer the zone, separated by commas")
+	viper.BindPFlag("secondaries", command.Flags().Lookup("secondaries"))
+
+	command.Flags().String("tsig-key", "", "TSIG key secondaries sign zone transfers with, formatted as name:base64-secret")
+	viper.BindPFlag("tsig-key", command.Flags().Lookup("tsig-key"))
+
+	command.Flags().String("chaos-version-bind", "", "Answer to CHAOS TXT queries for version.bind, defaults to the build version, none to refuse them")
+	viper.BindPFlag("chaos-version-bind", command.Flags().Lookup("chaos-version-bind"))
+
+	command.Flags().String("chaos-hostname-bind", "", "Answer to CHAOS TXT queries for hostname.bind, defaults to the instance identifier, none to refuse them")
+	viper.BindPFlag("chaos-hostname-bind", command.Flags().Lookup("chaos-hostname-bind"))
+
+	command.Flags().String("chaos-id-server", "", "Answer to CHAOS TXT queries for id.server, defaults to the instance identifier, none to refuse them")
+	viper.BindPFlag("chaos-id-server", command.Flags().Lookup("chaos-id-server"))
+
+	command.Flags().String("chaos-version-server", "", "Answer to CHAOS TXT queries for version.server, defaults to the build version, none to refuse them")
+	viper.BindPFlag("chaos-version-server", command.Flags().Lookup("chaos-version-server"))
+
+	command.Flags().String("nsid", "", "Identifier returned to clients asking for an NSID, defaults to the instance identifier, none to disable it")
+	viper.BindPFlag("nsid", command.Flags().Lookup("nsid"))
+
+	command.Flags().Int("rrl-responses-per-second", 0, "Responses per second allowed for each name and type to each client network over UDP, 0 to disable")
+	viper.BindPFlag("rrl-responses-per-second", command.Flags().Lookup("rrl-responses-per-second"))
+
+	command.Flags().Int("rrl-nxdomains-per-second", 0, "NXDOMAIN responses per second allowed to each client network over UDP, 0 to disable")
+	viper.BindPFlag("rrl-nxdomains-per-second", command.Flags().Lookup("rrl-nxdomains-per-second"))
+
+	command.Flags().Int("rrl-errors-per-second", 0, "Error responses per second allowed to each client network over UDP, 0 to disable")
+	viper.BindPFlag("rrl-errors-per-second", command.Flags().Lookup("rrl-errors-per-second"))
+
+	command.Flags().Int("rrl-all-per-second", 0, "Responses per second allowed to each client network over UDP, whatever their kind, 0 to disable")
+	viper.BindPFlag("rrl-all-per-second", command.Flags().Lookup("rrl-all-per-second"))
+
+	command.Flags().Duration("rrl-window", 15*time.Second, "Period over which response rates are measured")
+	viper.BindPFlag("rrl-window", command.Flags().Lookup("rrl-window"))
+
+	command.Flags().Int("rrl-slip", 2, "Send every nth rate limited response truncated instead of dropping it, 0 to drop them all")
+	viper.BindPFlag("rrl-slip", command.Flags().Lookup("rrl-slip"))
+
+	command.Flags().String("rrl-exempt", "", "List of client networks exempt from rate limiting in CIDR notation, separated by commas")
+	viper.BindPFlag("rrl-exempt", command.Flags().Lookup("rrl-exempt"))
+
+	command.Flags().Bool("dnssec", false, "Enable to sign answers with DNSSEC")
+	viper.BindPFlag("dnssec", command.Flags().Lookup("dnssec"))
+
+	command.Flags().String("dnssec-keys-dir", "./.lego/dnssec", "Directory where DNSSEC keys are loaded from, or generated into on the first run")
+	viper.BindPFlag("dnssec-keys-dir", command.Flags().Lookup("dnssec-keys-dir"))
+
 	command.Flags().String("domain", "", "Root domain (required)")
 	viper.BindPFlag("domain", command.Flags().Lookup("domain"))
 
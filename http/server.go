@@ -7,7 +7,6 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -29,9 +28,14 @@ func loggingMiddleware(w http.ResponseWriter, r *http.Request, next http.Handler
 	logEvent.Msgf("%s %s %d %s", r.Method, r.URL.Path, response.Status(), time.Since(start))
 }
 
-func newHttpMux() http.Handler {
+// newHttpMux serves the website, the wildcard certificate, and DNS over
+// HTTPS requests with dohHandler.
+func newHttpMux(dohHandler http.Handler) http.Handler {
 	mux := http.NewServeMux()
 
+	mux.Handle("GET /dns-query", dohHandler)
+	mux.Handle("POST /dns-query", dohHandler)
+
 	mux.HandleFunc("GET /server.key", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/octet-stream")
 		http.ServeFile(w, r, "./.lego/certs/wildcard/server.key")
@@ -69,28 +73,36 @@ func newHttpMux() http.Handler {
 	return n
 }
 
-func serveHttp() *http.Server {
-	config := utils.GetConfig()
-	httpServer := &http.Server{
-		Addr:    fmt.Sprintf(":%d", config.HttpPort),
-		Handler: newHttpMux(),
-	}
-	utils.Logger.Info().Str("http_address", httpServer.Addr).Msg("Starting up HTTP server")
-	go func() {
-		err := httpServer.ListenAndServe()
-		if err != http.ErrServerClosed {
-			utils.Logger.Fatal().Err(err).Msg("Unexpected error received from HTTP server")
+func serveHttp(dohHandler http.Handler) []*http.Server {
+	mux := newHttpMux(dohHandler)
+	var httpServers []*http.Server
+	for _, addr := range utils.GetConfig().HttpListen {
+		httpServer := &http.Server{
+			Addr:    addr,
+			Handler: mux,
 		}
-	}()
-	return httpServer
+		utils.Logger.Info().Str("http_address", httpServer.Addr).Msg("Starting up HTTP server")
+		go func() {
+			err := httpServer.ListenAndServe()
+			if err != http.ErrServerClosed {
+				utils.Logger.Fatal().Err(err).Msg("Unexpected error received from HTTP server")
+			}
+		}()
+		httpServers = append(httpServers, httpServer)
+	}
+	return httpServers
 }
 
-func waitForCertificate(ready chan bool) {
+func waitForCertificate(ctx context.Context, ready chan bool) {
 	for {
 		_, err := os.Stat("./.lego/certs/root/output.json")
 		if err != nil {
 			if strings.Contains(err.Error(), "no such file or directory") {
-				time.Sleep(1 * time.Second)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(1 * time.Second):
+				}
 				continue
 			}
 			utils.Logger.Fatal().Err(err).Msg("Unexpected error while looking for ./.lego/certs/root/output.json")
@@ -101,46 +113,57 @@ func waitForCertificate(ready chan bool) {
 	ready <- true
 }
 
-func killServer(httpServer *http.Server) {
+func killServers(httpServers []*http.Server) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	err := httpServer.Shutdown(ctx)
-	if err != nil {
-		utils.Logger.Fatal().Err(err).Msg("Unexpected error when shutting down HTTP server")
-	}
+	for _, httpServer := range httpServers {
+		err := httpServer.Shutdown(ctx)
+		if err != nil {
+			utils.Logger.Error().Err(err).Str("address", httpServer.Addr).Msg("Unexpected error when shutting down HTTP server")
+			continue
+		}
 
-	utils.Logger.Debug().Msg("HTTP server shut down correctly")
+		utils.Logger.Debug().Str("address", httpServer.Addr).Msg("HTTP server shut down correctly")
+	}
 }
 
-func redirectHttpToHttps() {
-	config := utils.GetConfig()
-	httpServer := &http.Server{
-		Addr: fmt.Sprintf(":%d", config.HttpPort),
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			url := r.URL
-			host := r.Host
-
-			// Strip the port from the host if present
-			if strings.Contains(host, ":") {
-				hostWithoutPort, _, err := net.SplitHostPort(host)
-				if err != nil {
-					utils.Logger.Error().Err(err).Msg("Failed to split host and port")
-				} else {
-					host = hostWithoutPort
-				}
-			}
-			// Add the HTTPS port only if it's not 443
-			if config.HttpsPort != 443 {
-				host = net.JoinHostPort(host, strconv.FormatUint(uint64(config.HttpsPort), 10))
+func redirectHttpToHttps() []*http.Server {
+	// redirect to the port of the first HTTPS address
+	_, httpsPort, _ := net.SplitHostPort(utils.GetConfig().HttpsListen[0])
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		url := r.URL
+		host := r.Host
+
+		// Strip the port from the host if present
+		if strings.Contains(host, ":") {
+			hostWithoutPort, _, err := net.SplitHostPort(host)
+			if err != nil {
+				utils.Logger.Error().Err(err).Msg("Failed to split host and port")
+			} else {
+				host = hostWithoutPort
 			}
+		}
+		// Add the HTTPS port only if it's not 443
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+
+		url.Host = host
+		url.Scheme = "https"
+		http.Redirect(w, r, url.String(), http.StatusMovedPermanently)
+	})
 
-			url.Host = host
-			url.Scheme = "https"
-			http.Redirect(w, r, url.String(), http.StatusMovedPermanently)
-		}),
+	var httpServers []*http.Server
+	for _, addr := range utils.GetConfig().HttpListen {
+		httpServer := &http.Server{
+			Addr:    addr,
+			Handler: redirect,
+		}
+		utils.Logger.Info().Str("http_address", httpServer.Addr).Msg("Redirecting HTTP traffic to HTTPS")
+		go httpServer.ListenAndServe()
+		httpServers = append(httpServers, httpServer)
 	}
-	utils.Logger.Info().Str("http_address", httpServer.Addr).Msg("Redirecting HTTP traffic to HTTPS")
-	go httpServer.ListenAndServe()
+	return httpServers
 }
 
 type CertificateReloader struct {
@@ -181,37 +204,60 @@ func (cr *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certif
 	return cr.certificate, nil
 }
 
-var certificateReloader = &CertificateReloader{
-	CertificateFilePath: "./.lego/certs/root/server.pem",
-	KeyFilePath:         "./.lego/certs/root/server.key",
-}
-
-func serveHttps() {
-	config := utils.GetConfig()
-	mux := newHttpMux()
-	httpsServer := &http.Server{
-		Addr:      fmt.Sprintf(":%d", config.HttpsPort),
-		Handler:   mux,
-		TLSConfig: &tls.Config{GetCertificate: certificateReloader.GetCertificate},
+var (
+	// RootCertificate follows the certificate of the domain itself.
+	RootCertificate = &CertificateReloader{
+		CertificateFilePath: "./.lego/certs/root/server.pem",
+		KeyFilePath:         "./.lego/certs/root/server.key",
+	}
+	// WildcardCertificate follows the certificate of the subdomains.
+	WildcardCertificate = &CertificateReloader{
+		CertificateFilePath: "./.lego/certs/wildcard/server.pem",
+		KeyFilePath:         "./.lego/certs/wildcard/server.key",
 	}
-	utils.Logger.Info().Str("https_address", httpsServer.Addr).Msg("Starting up HTTPS server")
-	go func() {
-		err := httpsServer.ListenAndServeTLS("", "")
-		if err != http.ErrServerClosed {
-			utils.Logger.Fatal().Err(err).Msg("Unexpected error received from HTTPS server")
+)
+
+func serveHttps(dohHandler http.Handler) []*http.Server {
+	mux := newHttpMux(dohHandler)
+	var httpsServers []*http.Server
+	for _, addr := range utils.GetConfig().HttpsListen {
+		httpsServer := &http.Server{
+			Addr:      addr,
+			Handler:   mux,
+			TLSConfig: &tls.Config{GetCertificate: RootCertificate.GetCertificate},
 		}
-	}()
+		utils.Logger.Info().Str("https_address", httpsServer.Addr).Msg("Starting up HTTPS server")
+		go func() {
+			err := httpsServer.ListenAndServeTLS("", "")
+			if err != http.ErrServerClosed {
+				utils.Logger.Fatal().Err(err).Msg("Unexpected error received from HTTPS server")
+			}
+		}()
+		httpsServers = append(httpsServers, httpsServer)
+	}
+	return httpsServers
 }
 
-func ServeHttp() {
-	httpServer := serveHttp()
+// ServeHttp serves the website over HTTP until the certificates are
+// obtained, then over HTTPS, until ctx is done. DNS over HTTPS requests go
+// to dohHandler.
+func ServeHttp(ctx context.Context, dohHandler http.Handler) {
+	httpServers := serveHttp(dohHandler)
 
 	ready := make(chan bool, 1)
-	go waitForCertificate(ready)
-	<-ready
+	go waitForCertificate(ctx, ready)
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		killServers(httpServers)
+		return
+	}
+
+	killServers(httpServers)
 
-	killServer(httpServer)
+	httpsServers := serveHttps(dohHandler)
+	redirectServers := redirectHttpToHttps()
 
-	serveHttps()
-	redirectHttpToHttps()
+	<-ctx.Done()
+	killServers(append(httpsServers, redirectServers...))
 }
@@ -1,17 +1,63 @@
 package utils
 
 import (
+	"time"
+
 	"github.com/spf13/viper"
 )
 
 type config struct {
-	DnsPort   uint `mapstructure:"dns-port"`
-	HttpPort  uint `mapstructure:"http-port"`
-	HttpsPort uint `mapstructure:"https-port"`
-	Domain    string
-	Email     string
+	DnsPort               uint `mapstructure:"dns-port"`
+	DnsSockets            int  `mapstructure:"dns-sockets"`
+	HttpPort              uint `mapstructure:"http-port"`
+	HttpsPort             uint `mapstructure:"https-port"`
+	Dot                   bool
+	DotPort               uint `mapstructure:"dot-port"`
+	Doq                   bool
+	DoqPort               uint   `mapstructure:"doq-port"`
+	DoqMaxStreams         int64  `mapstructure:"doq-max-streams"`
+	MetricsAddress        string `mapstructure:"metrics-address"`
+	Dnstap                string
+	Workers               int
+	QueryTimeout          time.Duration `mapstructure:"query-timeout"`
+	EdnsUdpSize           uint16        `mapstructure:"edns-udp-size"`
+	Dnssec                bool
+	DnssecKeysDir         string `mapstructure:"dnssec-keys-dir"`
+	ZoneFile              string `mapstructure:"zone-file"`
+	TTL                   time.Duration
+	SynthesizedTTL        time.Duration `mapstructure:"ttl-synthesized"`
+	TypeTTLs              map[string]time.Duration
+	NameTTLs              map[string]time.Duration
+	SOARefresh            time.Duration `mapstructure:"soa-refresh"`
+	SOARetry              time.Duration `mapstructure:"soa-retry"`
+	SOAExpire             time.Duration `mapstructure:"soa-expire"`
+	SOAMinimum            time.Duration `mapstructure:"soa-minimum"`
+	AnyResponse           string        `mapstructure:"any-response"`
+	CAA                   bool
+	CAAIssuer             string `mapstructure:"caa-issuer"`
+	CAAAccountURI         bool   `mapstructure:"caa-account-uri"`
+	Secondaries           []string
+	RRLResponsesPerSecond int           `mapstructure:"rrl-responses-per-second"`
+	RRLNxdomainsPerSecond int           `mapstructure:"rrl-nxdomains-per-second"`
+	RRLErrorsPerSecond    int           `mapstructure:"rrl-errors-per-second"`
+	RRLAllPerSecond       int           `mapstructure:"rrl-all-per-second"`
+	RRLWindow             time.Duration `mapstructure:"rrl-window"`
+	RRLSlip               int           `mapstructure:"rrl-slip"`
+	RRLExempt             []string
+	TsigKey               string `mapstructure:"tsig-key"`
+	ChaosVersionBind      string `mapstructure:"chaos-version-bind"`
+	ChaosHostnameBind     string `mapstructure:"chaos-hostname-bind"`
+	ChaosIdServer         string `mapstructure:"chaos-id-server"`
+	ChaosVersionServer    string `mapstructure:"chaos-version-server"`
+	Nsid                  string
+	Domain                string
+	Email                 string
 
 	NameServers     []string
+	DnsListen       []string
+	DnsTcpListen    []string
+	HttpListen      []string
+	HttpsListen     []string
 	CADirURL        string
 	AccountFilePath string
 	KeyFilePath     string
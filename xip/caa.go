@@ -0,0 +1,79 @@
+package xip
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// caaIssuerDomains maps the hostnames of well-known ACME directories to the
+// issuer domain names their CA recognizes in CAA records.
+var caaIssuerDomains = map[string]string{
+	"acme-v02.api.letsencrypt.org":         "letsencrypt.org",
+	"acme-staging-v02.api.letsencrypt.org": "letsencrypt.org",
+	"acme.zerossl.com":                     "sectigo.com",
+	"dv.acme-v02.api.pki.goog":             "pki.goog",
+	"api.buypass.com":                      "buypass.com",
+}
+
+// caaIssuerFromDirectory guesses the CAA issuer domain name of the CA behind
+// an ACME directory URL, falling back to the directory's registrable domain.
+func caaIssuerFromDirectory(caDirURL string) string {
+	parsedUrl, err := url.Parse(caDirURL)
+	if err != nil || parsedUrl.Hostname() == "" {
+		return ""
+	}
+
+	hostname := strings.ToLower(parsedUrl.Hostname())
+	if issuer, ok := caaIssuerDomains[hostname]; ok {
+		return issuer
+	}
+
+	labels := dns.SplitDomainName(hostname)
+	if len(labels) < 2 {
+		return hostname
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// caaRecords restricts issuance, wildcard included, to the configured CA and
+// optionally to our ACME account, and tells CAs where to report violations.
+func (xip *Xip) caaRecords() []*dns.CAA {
+	if xip.caaIssuer == "" {
+		return nil
+	}
+
+	value := xip.caaIssuer
+	if xip.caaPinAccount && xip.caaAccountURI != "" {
+		value = fmt.Sprintf("%s; accounturi=%s", xip.caaIssuer, xip.caaAccountURI)
+	}
+
+	records := []*dns.CAA{
+		{Flag: 0, Tag: "issue", Value: value},
+		{Flag: 0, Tag: "issuewild", Value: value},
+	}
+	if xip.email != "" {
+		records = append(records, &dns.CAA{Flag: 0, Tag: "iodef", Value: "mailto:" + xip.email})
+	}
+
+	return records
+}
+
+// SetCAAAccountURI pins the CAA records to the ACME account at uri, once it
+// is known, when account pinning is enabled.
+func (xip *Xip) SetCAAAccountURI(uri string) {
+	xip.recordsMu.Lock()
+	defer xip.recordsMu.Unlock()
+
+	xip.caaAccountURI = uri
+	if xip.caaIssuer == "" || !xip.caaPinAccount {
+		return
+	}
+
+	rootRecords := xip.dynamicRecords[xip.zone()]
+	rootRecords.CAA = xip.caaRecords()
+	xip.dynamicRecords[xip.zone()] = rootRecords
+	xip.rebuildRecords()
+}
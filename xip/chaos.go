@@ -0,0 +1,147 @@
+package xip
+
+import (
+	"encoding/hex"
+	"os"
+	"runtime/debug"
+	"strings"
+
+	"github.com/miekg/dns"
+	"local-ip.sh/utils"
+)
+
+// chaosDisabled is the configured value turning off a CHAOS record or NSID.
+const chaosDisabled = "none"
+
+// Names of the CHAOS class TXT records identifying the server.
+const (
+	ChaosVersionBind   = "version.bind."
+	ChaosHostnameBind  = "hostname.bind."
+	ChaosIdServer      = "id.server."
+	ChaosVersionServer = "version.server."
+)
+
+// WithChaosRecords answers CHAOS class TXT queries for the names of records,
+// such as ChaosHostnameBind, with their value. Other names are refused.
+func WithChaosRecords(records map[string]string) Option {
+	return func(x *Xip) {
+		x.chaosRecords = map[string]string{}
+		for name, value := range records {
+			x.chaosRecords[dns.CanonicalName(name)] = value
+		}
+	}
+}
+
+// WithNsid returns id in an NSID EDNS option (RFC 5001) to the clients that
+// ask for it, "" disabling it.
+func WithNsid(id string) Option {
+	return func(x *Xip) {
+		x.nsid = id
+	}
+}
+
+// buildVersion returns the module version local-ip.sh was built as, stamped
+// by the Go toolchain from the VCS tag or revision, "(devel)" without one.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" {
+		return "(devel)"
+	}
+
+	return info.Main.Version
+}
+
+// instanceIdentifier names the running instance: its hostname, prefixed
+// with its region when running on Fly.io.
+func instanceIdentifier() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	if flyRegion != "" {
+		return flyRegion + "/" + hostname
+	}
+
+	return hostname
+}
+
+// chaosRecordsFromConfig returns the configured CHAOS records, the disabled
+// ones left out. Empty versions default to the build version and empty
+// identities to the instance identifier.
+func chaosRecordsFromConfig() map[string]string {
+	config := utils.GetConfig()
+	records := map[string]string{}
+	for name, value := range map[string]string{
+		ChaosVersionBind:   config.ChaosVersionBind,
+		ChaosHostnameBind:  config.ChaosHostnameBind,
+		ChaosIdServer:      config.ChaosIdServer,
+		ChaosVersionServer: config.ChaosVersionServer,
+	} {
+		switch {
+		case value == chaosDisabled:
+		case value == "" && (name == ChaosVersionBind || name == ChaosVersionServer):
+			records[name] = buildVersion()
+		case value == "":
+			records[name] = instanceIdentifier()
+		default:
+			records[name] = value
+		}
+	}
+
+	return records
+}
+
+// nsidFromConfig returns the configured NSID, defaulting to the instance
+// identifier.
+func nsidFromConfig() string {
+	switch nsid := utils.GetConfig().Nsid; nsid {
+	case chaosDisabled:
+		return ""
+	case "":
+		return instanceIdentifier()
+	default:
+		return nsid
+	}
+}
+
+// handleChaos answers CHAOS class queries, which are about the server rather
+// than the zone.
+func (xip *Xip) handleChaos(question dns.Question, message *dns.Msg) {
+	value, ok := xip.chaosRecords[strings.ToLower(question.Name)]
+	if !ok {
+		message.Rcode = dns.RcodeRefused
+		return
+	}
+	if question.Qtype != dns.TypeTXT && question.Qtype != dns.TypeANY {
+		return
+	}
+
+	message.Answer = append(message.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   question.Name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassCHAOS,
+			Ttl:    0,
+		},
+		Txt: []string{value},
+	})
+}
+
+// addNsid answers the NSID option of request, if any, in the OPT record of
+// message.
+func (xip *Xip) addNsid(request *dns.Msg, message *dns.Msg) {
+	requestOpt, responseOpt := request.IsEdns0(), message.IsEdns0()
+	if xip.nsid == "" || requestOpt == nil || responseOpt == nil {
+		return
+	}
+
+	for _, option := range requestOpt.Option {
+		if option.Option() == dns.EDNS0NSID {
+			responseOpt.Option = append(responseOpt.Option, &dns.EDNS0_NSID{
+				Code: dns.EDNS0NSID,
+				Nsid: hex.EncodeToString([]byte(xip.nsid)),
+			})
+			return
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package xip
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"local-ip.sh/utils"
+)
+
+const (
+	dnssecAlgorithm      = dns.ECDSAP256SHA256
+	dnssecKeyBits        = 256
+	rrsigValidity        = 7 * 24 * time.Hour
+	rrsigInceptionOffset = time.Hour
+)
+
+type dnssecKey struct {
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// loadDnssecKeys loads the key signing key and the zone signing key from the
+// configured directory, generating and persisting them on the first run, and
+// logs the DS record to hand to the registrar.
+func (xip *Xip) loadDnssecKeys() error {
+	err := os.MkdirAll(xip.dnssecKeysDir, 0o700)
+	if err != nil {
+		return fmt.Errorf("failed to create DNSSEC keys directory: %w", err)
+	}
+
+	xip.ksk, err = xip.loadOrGenerateDnssecKey("ksk", dns.ZONE|dns.SEP)
+	if err != nil {
+		return err
+	}
+
+	xip.zsk, err = xip.loadOrGenerateDnssecKey("zsk", dns.ZONE)
+	if err != nil {
+		return err
+	}
+
+	ds := xip.ksk.dnskey.ToDS(dns.SHA256)
+	utils.Logger.Info().Str("ds", anyWhitespaceRegex.ReplaceAllString(ds.String(), " ")).Msg("DNSSEC enabled, publish this DS record at your registrar")
+	return nil
+}
+
+func (xip *Xip) loadOrGenerateDnssecKey(name string, flags uint16) (*dnssecKey, error) {
+	publicKeyPath := filepath.Join(xip.dnssecKeysDir, name+".key")
+	privateKeyPath := filepath.Join(xip.dnssecKeysDir, name+".private")
+
+	publicKeyFile, err := os.ReadFile(publicKeyPath)
+	if os.IsNotExist(err) {
+		return xip.generateDnssecKey(flags, publicKeyPath, privateKeyPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DNSSEC public key %s: %w", publicKeyPath, err)
+	}
+
+	rr, err := dns.NewRR(string(publicKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DNSSEC public key %s: %w", publicKeyPath, err)
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok || dnskey.Flags != flags || !strings.EqualFold(dnskey.Hdr.Name, xip.zone()) {
+		return nil, fmt.Errorf("%s is not a %s DNSKEY for %s", publicKeyPath, name, xip.zone())
+	}
+
+	privateKeyFile, err := os.Open(privateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DNSSEC private key %s: %w", privateKeyPath, err)
+	}
+	defer privateKeyFile.Close()
+
+	privateKey, err := dnskey.ReadPrivateKey(privateKeyFile, privateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DNSSEC private key %s: %w", privateKeyPath, err)
+	}
+
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("DNSSEC private key %s cannot sign", privateKeyPath)
+	}
+
+	return &dnssecKey{dnskey, signer}, nil
+}
+
+func (xip *Xip) generateDnssecKey(flags uint16, publicKeyPath string, privateKeyPath string) (*dnssecKey, error) {
+	dnskey := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   xip.zone(),
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    uint32((time.Hour).Seconds()),
+		},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dnssecAlgorithm,
+	}
+	privateKey, err := dnskey.Generate(dnssecKeyBits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate DNSSEC key: %w", err)
+	}
+
+	err = os.WriteFile(privateKeyPath, []byte(dnskey.PrivateKeyString(privateKey)), 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write DNSSEC private key %s: %w", privateKeyPath, err)
+	}
+
+	err = os.WriteFile(publicKeyPath, []byte(dnskey.String()+"\n"), 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write DNSSEC public key %s: %w", publicKeyPath, err)
+	}
+
+	utils.Logger.Info().Str("path", publicKeyPath).Uint16("keytag", dnskey.KeyTag()).Msg("Generated DNSSEC key")
+	return &dnssecKey{dnskey, privateKey.(crypto.Signer)}, nil
+}
+
+func (xip *Xip) dnssecEnabled() bool {
+	return xip.ksk != nil && xip.zsk != nil
+}
+
+func (xip *Xip) handleDNSKEY(question dns.Question, message *dns.Msg) {
+	if !xip.dnssecEnabled() || !strings.EqualFold(question.Name, xip.zone()) {
+		xip.answerWithAuthority(question, message)
+		return
+	}
+
+	for _, key := range []*dnssecKey{xip.ksk, xip.zsk} {
+		dnskey := *key.dnskey
+		dnskey.Hdr.Name = question.Name
+		dnskey.Hdr.Ttl = xip.ttls.forRecord(question.Name, dns.TypeDNSKEY)
+		message.Answer = append(message.Answer, &dnskey)
+	}
+}
+
+// signResponse adds DNSSEC records to the response of a client that set the
+// DO bit. Denial of existence uses "black lies": a name that doesn't exist is
+// answered as NODATA with a minimal NSEC record covering just that name, so
+// nothing has to be pre-computed for the infinity of synthesized names.
+func (xip *Xip) signResponse(request *dns.Msg, message *dns.Msg) {
+	opt := request.IsEdns0()
+	if !xip.dnssecEnabled() || opt == nil || !opt.Do() || len(message.Question) != 1 {
+		return
+	}
+	if message.Question[0].Qclass != dns.ClassINET {
+		// only the records of the zone are signed, not the CHAOS ones
+		return
+	}
+
+	if message.Rcode == dns.RcodeNameError {
+		message.Rcode = dns.RcodeSuccess
+		message.Ns = append(message.Ns, xip.nsecRecord(message.Question[0].Name, []uint16{dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNXNAME}))
+	} else if message.Rcode == dns.RcodeSuccess && len(message.Answer) == 0 {
+		name := message.Question[0].Name
+		message.Ns = append(message.Ns, xip.nsecRecord(name, xip.typesAt(name)))
+	}
+
+	message.AuthenticatedData = false
+	message.Answer = xip.signRecords(message.Answer)
+	message.Ns = xip.signRecords(message.Ns)
+	message.Extra = xip.signRecords(message.Extra)
+}
+
+func (xip *Xip) nsecRecord(name string, types []uint16) *dns.NSEC {
+	return &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    seconds(xip.ttls.SOAMinimum),
+		},
+		NextDomain: "\\000." + name,
+		TypeBitMap: types,
+	}
+}
+
+// typesAt lists the record types that exist at name, for NSEC type bitmaps.
+func (xip *Xip) typesAt(name string) []uint16 {
+	types := []uint16{dns.TypeRRSIG, dns.TypeNSEC}
+	if strings.EqualFold(name, xip.zone()) {
+		types = append(types, dns.TypeNS, dns.TypeSOA, dns.TypeDNSKEY)
+	}
+
+	normalizedName := strings.ToLower(name)
+	records := xip.records.Load().records(normalizedName)
+	if len(records.TXT) > 0 {
+		types = append(types, dns.TypeTXT)
+	}
+	if len(records.MX) > 0 {
+		types = append(types, dns.TypeMX)
+	}
+	if len(records.CNAME) > 0 {
+		types = append(types, dns.TypeCNAME)
+	}
+	if len(records.SRV) > 0 {
+		types = append(types, dns.TypeSRV)
+	}
+	if len(records.CAA) > 0 {
+		types = append(types, dns.TypeCAA)
+	}
+	if len(xip.fqdnToA(name)) > 0 {
+		types = append(types, dns.TypeA)
+	}
+	if len(xip.fqdnToAAAA(name)) > 0 {
+		types = append(types, dns.TypeAAAA)
+	}
+
+	slices.Sort(types)
+	return types
+}
+
+// signRecords appends an RRSIG after every RRset of records. DNSKEY RRsets
+// are signed with the key signing key, everything else with the zone
+// signing key.
+func (xip *Xip) signRecords(records []dns.RR) []dns.RR {
+	signed := make([]dns.RR, 0, len(records)*2)
+	for _, rrset := range groupRRsets(records) {
+		signed = append(signed, rrset...)
+
+		rrtype := rrset[0].Header().Rrtype
+		if rrtype == dns.TypeOPT || rrtype == dns.TypeRRSIG {
+			continue
+		}
+
+		key := xip.zsk
+		if rrtype == dns.TypeDNSKEY {
+			key = xip.ksk
+		}
+
+		now := time.Now()
+		rrsig := &dns.RRSIG{
+			Hdr: dns.RR_Header{
+				Ttl: rrset[0].Header().Ttl,
+			},
+			KeyTag:     key.dnskey.KeyTag(),
+			SignerName: xip.zone(),
+			Algorithm:  key.dnskey.Algorithm,
+			Inception:  uint32(now.Add(-rrsigInceptionOffset).Unix()),
+			Expiration: uint32(now.Add(rrsigValidity).Unix()),
+		}
+		err := rrsig.Sign(key.signer, rrset)
+		if err != nil {
+			utils.Logger.Error().Err(err).Str("name", rrset[0].Header().Name).Msg("Failed to sign RRset")
+			continue
+		}
+
+		signed = append(signed, rrsig)
+	}
+
+	return signed
+}
+
+// groupRRsets splits records into RRsets, keeping the order in which each
+// RRset first appears.
+func groupRRsets(records []dns.RR) [][]dns.RR {
+	var rrsets [][]dns.RR
+	for _, record := range records {
+		found := false
+		for i, rrset := range rrsets {
+			header := rrset[0].Header()
+			if header.Rrtype == record.Header().Rrtype && header.Class == record.Header().Class && strings.EqualFold(header.Name, record.Header().Name) {
+				rrsets[i] = append(rrset, record)
+				found = true
+				break
+			}
+		}
+		if !found {
+			rrsets = append(rrsets, []dns.RR{record})
+		}
+	}
+
+	return rrsets
+}
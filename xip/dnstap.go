@@ -0,0 +1,171 @@
+package xip
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+	"local-ip.sh/utils"
+)
+
+// dnstapLogger emits AUTH_QUERY and AUTH_RESPONSE dnstap messages for every
+// request answered. Messages are dropped rather than slowing down answers
+// when the output can't keep up.
+type dnstapLogger struct {
+	output  dnstap.Output
+	frames  chan []byte
+	dropped atomic.Uint64
+	// mu guards frames against being sent to once closed, by queries still
+	// answered when the output gets closed.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newDnstapLogger starts writing dnstap messages to target, either
+// "unix:/path/to/socket" for a framestream socket or "file:/path/to/file"
+// for a framestream file, which gets truncated.
+func newDnstapLogger(target string) (*dnstapLogger, error) {
+	var output dnstap.Output
+	scheme, path, _ := strings.Cut(target, ":")
+	switch {
+	case scheme == "unix" && path != "":
+		socketOutput, err := dnstap.NewFrameStreamSockOutput(&net.UnixAddr{Name: path, Net: "unix"})
+		if err != nil {
+			return nil, err
+		}
+		socketOutput.SetLogger(dnstapErrorLogger{})
+		output = socketOutput
+	case scheme == "file" && path != "":
+		fileOutput, err := dnstap.NewFrameStreamOutputFromFilename(path)
+		if err != nil {
+			return nil, err
+		}
+		fileOutput.SetLogger(dnstapErrorLogger{})
+		output = fileOutput
+	default:
+		return nil, fmt.Errorf("invalid dnstap output %q, expected unix:/path or file:/path", target)
+	}
+
+	go output.RunOutputLoop()
+	return &dnstapLogger{output: output, frames: output.GetOutputChannel()}, nil
+}
+
+// logQuery emits the AUTH_QUERY message of request, received at start.
+func (d *dnstapLogger) logQuery(response dns.ResponseWriter, request *dns.Msg, start time.Time) {
+	message := newDnstapMessage(dnstap.Message_AUTH_QUERY, response)
+	message.QueryMessage, _ = request.Pack()
+	message.QueryTimeSec, message.QueryTimeNsec = dnstapTime(start)
+	d.emit(message)
+}
+
+// logResponse emits the AUTH_RESPONSE message of reply, answering request
+// received at start.
+func (d *dnstapLogger) logResponse(response dns.ResponseWriter, request *dns.Msg, reply *dns.Msg, start time.Time) {
+	message := newDnstapMessage(dnstap.Message_AUTH_RESPONSE, response)
+	message.QueryMessage, _ = request.Pack()
+	message.QueryTimeSec, message.QueryTimeNsec = dnstapTime(start)
+	message.ResponseMessage, _ = reply.Pack()
+	message.ResponseTimeSec, message.ResponseTimeNsec = dnstapTime(time.Now())
+	d.emit(message)
+}
+
+func (d *dnstapLogger) emit(message *dnstap.Message) {
+	frame, err := proto.Marshal(&dnstap.Dnstap{
+		Type:    dnstap.Dnstap_MESSAGE.Enum(),
+		Message: message,
+	})
+	if err != nil {
+		utils.Logger.Error().Err(err).Msg("Failed to encode dnstap message")
+		return
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return
+	}
+	select {
+	case d.frames <- frame:
+	default:
+		if d.dropped.Add(1)%1000 == 1 {
+			utils.Logger.Warn().Uint64("dropped", d.dropped.Load()).Msg("dnstap output is too slow, dropping messages")
+		}
+	}
+}
+
+// close flushes the pending messages and closes the output, messages of
+// later queries are dropped.
+func (d *dnstapLogger) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	d.closed = true
+	d.output.Close()
+}
+
+func newDnstapMessage(messageType dnstap.Message_Type, response dns.ResponseWriter) *dnstap.Message {
+	message := &dnstap.Message{Type: messageType.Enum()}
+
+	switch transport(response) {
+	case "tls":
+		message.SocketProtocol = dnstap.SocketProtocol_DOT.Enum()
+	case "https":
+		message.SocketProtocol = dnstap.SocketProtocol_DOH.Enum()
+	case "quic":
+		// DOQ in dnstap.proto, missing from the Go bindings
+		message.SocketProtocol = dnstap.SocketProtocol(7).Enum()
+	case "tcp":
+		message.SocketProtocol = dnstap.SocketProtocol_TCP.Enum()
+	default:
+		message.SocketProtocol = dnstap.SocketProtocol_UDP.Enum()
+	}
+
+	queryIp, queryPort := addrIpPort(response.RemoteAddr())
+	responseIp, responsePort := addrIpPort(response.LocalAddr())
+	if ip := queryIp.To4(); ip != nil {
+		message.SocketFamily = dnstap.SocketFamily_INET.Enum()
+		message.QueryAddress = ip
+		message.ResponseAddress = responseIp.To4()
+	} else {
+		message.SocketFamily = dnstap.SocketFamily_INET6.Enum()
+		message.QueryAddress = queryIp.To16()
+		message.ResponseAddress = responseIp.To16()
+	}
+	message.QueryPort = &queryPort
+	message.ResponsePort = &responsePort
+
+	return message
+}
+
+func addrIpPort(addr net.Addr) (net.IP, uint32) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP, uint32(addr.Port)
+	case *net.TCPAddr:
+		return addr.IP, uint32(addr.Port)
+	default:
+		return nil, 0
+	}
+}
+
+func dnstapTime(t time.Time) (*uint64, *uint32) {
+	sec := uint64(t.Unix())
+	nsec := uint32(t.Nanosecond())
+	return &sec, &nsec
+}
+
+// dnstapErrorLogger reports the errors of the dnstap outputs, such as
+// failures to connect to the socket.
+type dnstapErrorLogger struct{}
+
+func (dnstapErrorLogger) Printf(format string, v ...any) {
+	utils.Logger.Error().Msgf(format, v...)
+}
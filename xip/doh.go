@@ -0,0 +1,138 @@
+package xip
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+const dohContentType = "application/dns-message"
+
+// DohHandler serves DNS over HTTPS (RFC 8484) requests, both GET with the
+// base64url-encoded query in the "dns" parameter and POST with the query as
+// body. Answers are the same as over the other transports.
+func (xip *Xip) DohHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var query []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+			if err != nil || len(query) == 0 {
+				http.Error(w, "Invalid dns parameter", http.StatusBadRequest)
+				return
+			}
+		case http.MethodPost:
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if mediaType != dohContentType {
+				http.Error(w, fmt.Sprintf("Expected %s content", dohContentType), http.StatusUnsupportedMediaType)
+				return
+			}
+			query, err = io.ReadAll(http.MaxBytesReader(w, r.Body, dns.MaxMsgSize))
+			if err != nil {
+				http.Error(w, "Invalid body", http.StatusRequestEntityTooLarge)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		request := new(dns.Msg)
+		if err := request.Unpack(query); err != nil {
+			http.Error(w, "Invalid DNS message", http.StatusBadRequest)
+			return
+		}
+
+		response := newDohResponseWriter(w, r)
+		if isTransfer(request) {
+			message := new(dns.Msg)
+			message.SetRcode(request, dns.RcodeRefused)
+			response.WriteMsg(message)
+			return
+		}
+		if !xip.servePooled(response, request) {
+			http.Error(w, "Server overloaded", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// dohResponseWriter writes DNS responses as the body of HTTP responses.
+type dohResponseWriter struct {
+	w      http.ResponseWriter
+	local  net.Addr
+	remote net.Addr
+}
+
+func newDohResponseWriter(w http.ResponseWriter, r *http.Request) *dohResponseWriter {
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if local == nil {
+		local = &net.TCPAddr{}
+	}
+	var remote net.Addr = &net.TCPAddr{}
+	if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		remote = net.TCPAddrFromAddrPort(addrPort)
+	}
+
+	return &dohResponseWriter{w: w, local: local, remote: remote}
+}
+
+func (d *dohResponseWriter) LocalAddr() net.Addr  { return d.local }
+func (d *dohResponseWriter) RemoteAddr() net.Addr { return d.remote }
+
+func (d *dohResponseWriter) WriteMsg(message *dns.Msg) error {
+	packed, err := message.Pack()
+	if err != nil {
+		http.Error(d.w, "Failed to encode DNS message", http.StatusInternalServerError)
+		return err
+	}
+
+	// caches must not keep the response longer than its records
+	if ttl, ok := minTTL(message); ok {
+		d.w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	_, err = d.Write(packed)
+	return err
+}
+
+func (d *dohResponseWriter) Write(packed []byte) (int, error) {
+	d.w.Header().Set("Content-Type", dohContentType)
+	return d.w.Write(packed)
+}
+
+func (d *dohResponseWriter) Close() error { return nil }
+
+// TsigStatus fails since TSIG isn't verified over HTTPS.
+func (d *dohResponseWriter) TsigStatus() error {
+	return errors.New("TSIG is not supported over HTTPS")
+}
+
+func (d *dohResponseWriter) TsigTimersOnly(bool) {}
+func (d *dohResponseWriter) Hijack()             {}
+
+// minTTL returns the lowest TTL of the records of message, OPT aside.
+func minTTL(message *dns.Msg) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, records := range [][]dns.RR{message.Answer, message.Ns, message.Extra} {
+		for _, record := range records {
+			if record.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !found || record.Header().Ttl < ttl {
+				ttl = record.Header().Ttl
+				found = true
+			}
+		}
+	}
+
+	return ttl, found
+}
@@ -0,0 +1,188 @@
+package xip
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// Error codes of DNS over QUIC (RFC 9250 section 4.3).
+const (
+	doqNoError       quic.ApplicationErrorCode = 0x0
+	doqInternalError quic.ApplicationErrorCode = 0x1
+	doqProtocolError quic.ApplicationErrorCode = 0x2
+	doqExcessiveLoad quic.ApplicationErrorCode = 0x4
+)
+
+const (
+	defaultDoqMaxStreams = 100
+	doqIdleTimeout       = 30 * time.Second
+	doqReadTimeout       = 5 * time.Second
+)
+
+// WithDoqPort serves DNS over QUIC (RFC 9250) on port, 0 disabling it. It
+// requires WithTLSCertificates.
+func WithDoqPort(port uint) Option {
+	return func(x *Xip) {
+		x.doqPort = port
+	}
+}
+
+// WithDoqMaxStreams limits how many queries each DNS over QUIC connection
+// can have in flight.
+func WithDoqMaxStreams(streams int64) Option {
+	return func(x *Xip) {
+		x.doqMaxStreams = streams
+	}
+}
+
+// doqServer answers DNS over QUIC queries, one per stream, with the same
+// handling as the other transports.
+type doqServer struct {
+	xip      *Xip
+	addr     string
+	mu       sync.Mutex
+	listener *quic.Listener
+	shutdown bool
+}
+
+func (s *doqServer) ListenAndServe() error {
+	tlsConfig := s.xip.tlsConfig()
+	tlsConfig.NextProtos = []string{"doq"}
+	listener, err := quic.ListenAddr(s.addr, tlsConfig, &quic.Config{
+		MaxIdleTimeout:        doqIdleTimeout,
+		MaxIncomingStreams:    s.xip.doqMaxStreams,
+		MaxIncomingUniStreams: -1,
+	})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return listener.Close()
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept(context.Background())
+		if errors.Is(err, quic.ErrServerClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// ShutdownContext stops accepting connections. Streams being answered go on
+// until their query is, Xip.drain waits for them.
+func (s *doqServer) ShutdownContext(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shutdown = true
+	if s.listener == nil {
+		return nil
+	}
+
+	return s.listener.Close()
+}
+
+func (s *doqServer) serveConn(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(conn.Context())
+		if err != nil {
+			return
+		}
+		go s.serveStream(conn, stream)
+	}
+}
+
+// serveStream answers the query of stream, prefixed with its length like
+// over TCP, and closes the connection on protocol violations.
+func (s *doqServer) serveStream(conn *quic.Conn, stream *quic.Stream) {
+	defer stream.Close()
+
+	stream.SetReadDeadline(time.Now().Add(doqReadTimeout))
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		stream.CancelRead(quic.StreamErrorCode(doqProtocolError))
+		return
+	}
+	query := make([]byte, length)
+	if _, err := io.ReadFull(stream, query); err != nil {
+		stream.CancelRead(quic.StreamErrorCode(doqProtocolError))
+		return
+	}
+
+	request := new(dns.Msg)
+	if err := request.Unpack(query); err != nil || request.Id != 0 {
+		// queries must use ID 0, streams already tell them apart
+		conn.CloseWithError(doqProtocolError, "invalid DNS query")
+		return
+	}
+
+	response := &doqResponseWriter{conn: conn, stream: stream}
+	if isTransfer(request) {
+		message := new(dns.Msg)
+		message.SetRcode(request, dns.RcodeRefused)
+		response.WriteMsg(message)
+		return
+	}
+	if !s.xip.servePooled(response, request) {
+		stream.CancelWrite(quic.StreamErrorCode(doqExcessiveLoad))
+	}
+}
+
+// doqResponseWriter writes DNS responses to a DNS over QUIC stream.
+type doqResponseWriter struct {
+	conn   *quic.Conn
+	stream *quic.Stream
+}
+
+func (d *doqResponseWriter) LocalAddr() net.Addr  { return d.conn.LocalAddr() }
+func (d *doqResponseWriter) RemoteAddr() net.Addr { return d.conn.RemoteAddr() }
+
+func (d *doqResponseWriter) WriteMsg(message *dns.Msg) error {
+	packed, err := message.Pack()
+	if err != nil {
+		d.stream.CancelWrite(quic.StreamErrorCode(doqInternalError))
+		return err
+	}
+
+	_, err = d.Write(packed)
+	return err
+}
+
+func (d *doqResponseWriter) Write(packed []byte) (int, error) {
+	if len(packed) > dns.MaxMsgSize {
+		return 0, dns.ErrBuf
+	}
+
+	_, err := d.stream.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packed))), packed...))
+	if err != nil {
+		return 0, err
+	}
+	return len(packed), nil
+}
+
+func (d *doqResponseWriter) Close() error {
+	return d.conn.CloseWithError(doqNoError, "")
+}
+
+// TsigStatus fails since TSIG isn't verified over QUIC.
+func (d *doqResponseWriter) TsigStatus() error {
+	return errors.New("TSIG is not supported over QUIC")
+}
+
+func (d *doqResponseWriter) TsigTimersOnly(bool) {}
+func (d *doqResponseWriter) Hijack()             {}
@@ -0,0 +1,39 @@
+package xip
+
+import (
+	"github.com/miekg/dns"
+)
+
+// defaultEdnsUdpSize is the payload size recommended by DNS flag day 2020,
+// small enough to avoid IP fragmentation on most paths.
+const defaultEdnsUdpSize = 1232
+
+// checkEdns validates the OPT record of the request, if any. It returns false
+// when the request uses an EDNS version we don't support, in which case the
+// message has already been turned into a BADVERS response.
+func (xip *Xip) checkEdns(request *dns.Msg, message *dns.Msg) bool {
+	opt := request.IsEdns0()
+	if opt == nil || opt.Version() == 0 {
+		return true
+	}
+
+	message.Rcode = dns.RcodeBadVers
+	message.SetEdns0(xip.ednsUdpSize, opt.Do())
+	return false
+}
+
+// finishEdns echoes the OPT record of the request in the response, with our
+// NSID when asked for it, and, over UDP, truncates the response to what the
+// client can receive.
+func (xip *Xip) finishEdns(request *dns.Msg, message *dns.Msg, network string) {
+	size := dns.MinMsgSize
+	if opt := request.IsEdns0(); opt != nil {
+		message.SetEdns0(xip.ednsUdpSize, opt.Do())
+		xip.addNsid(request, message)
+		size = max(dns.MinMsgSize, min(int(opt.UDPSize()), int(xip.ednsUdpSize)))
+	}
+
+	if network == "udp" {
+		message.Truncate(size)
+	}
+}
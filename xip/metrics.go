@@ -0,0 +1,151 @@
+package xip
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"local-ip.sh/utils"
+)
+
+// Encodings of the addresses answered to A and AAAA queries, as found by
+// fqdnToA and fqdnToAAAA.
+const (
+	encodingStatic  = "static"
+	encodingDashed  = "dashed"
+	encodingDotted  = "dotted"
+	encodingHex     = "hex"
+	encodingDecimal = "decimal"
+	encodingIpV6    = "ipv6"
+	encodingNone    = "none"
+)
+
+type metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	addressAnswers  *prometheus.CounterVec
+	dropped         *prometheus.CounterVec
+}
+
+// newMetrics registers the metrics of xip in a registry of its own, so that
+// instances don't step on each other's toes.
+func newMetrics(xip *Xip) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "local_ip",
+			Subsystem: "dns",
+			Name:      "requests_total",
+			Help:      "DNS requests answered, by query type, response code and transport.",
+		}, []string{"qtype", "rcode", "transport"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "local_ip",
+			Subsystem: "dns",
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to answer DNS requests, by transport.",
+			Buckets:   []float64{.00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1},
+		}, []string{"transport"}),
+		addressAnswers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "local_ip",
+			Subsystem: "dns",
+			Name:      "address_answers_total",
+			Help:      "A and AAAA queries answered, by query type and encoding of the address: static records, or the one synthesized from the queried name.",
+		}, []string{"qtype", "encoding"}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "local_ip",
+			Subsystem: "dns",
+			Name:      "dropped_requests_total",
+			Help:      "UDP and TCP requests dropped unanswered because every worker was busy, by reason.",
+		}, []string{"reason"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.addressAnswers,
+		m.dropped,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	for action, count := range map[string]func(RateLimitStats) uint64{
+		"allowed": func(stats RateLimitStats) uint64 { return stats.Allowed },
+		"dropped": func(stats RateLimitStats) uint64 { return stats.Dropped },
+		"slipped": func(stats RateLimitStats) uint64 { return stats.Slipped },
+	} {
+		m.registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "local_ip",
+			Subsystem:   "dns",
+			Name:        "rate_limited_responses_total",
+			Help:        "UDP responses that went through response rate limiting, by outcome.",
+			ConstLabels: prometheus.Labels{"action": action},
+		}, func() float64 {
+			return float64(count(xip.RateLimitStats()))
+		}))
+	}
+
+	return m
+}
+
+// observeRequest records the response to a request received over transport
+// and how long it took since start.
+func (m *metrics) observeRequest(request *dns.Msg, response *dns.Msg, transport string, start time.Time) {
+	qtype := "none"
+	if len(request.Question) > 0 {
+		qtype = typeLabel(request.Question[0].Qtype)
+	}
+	rcode, ok := dns.RcodeToString[response.Rcode]
+	if !ok {
+		rcode = "other"
+	}
+
+	m.requests.WithLabelValues(qtype, rcode, transport).Inc()
+	m.requestDuration.WithLabelValues(transport).Observe(time.Since(start).Seconds())
+}
+
+func (m *metrics) observeAddressAnswer(qtype uint16, encoding string) {
+	m.addressAnswers.WithLabelValues(typeLabel(qtype), encoding).Inc()
+}
+
+func (m *metrics) observeDrop(reason string) {
+	m.dropped.WithLabelValues(reason).Inc()
+}
+
+// typeLabel names rrtype, keeping the cardinality of the metrics bounded
+// whatever types clients query.
+func typeLabel(rrtype uint16) string {
+	if name, ok := dns.TypeToString[rrtype]; ok {
+		return name
+	}
+
+	return "other"
+}
+
+// MetricsHandler serves the Prometheus metrics of the DNS server.
+func (xip *Xip) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(xip.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// ServeMetrics serves the Prometheus metrics on /metrics at addr until ctx
+// is done.
+func (xip *Xip) ServeMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", xip.MetricsHandler())
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	utils.Logger.Info().Str("metrics_address", addr).Msg("Starting up metrics server")
+	err := server.ListenAndServe()
+	if err != http.ErrServerClosed {
+		utils.Logger.Error().Err(err).Msg("Metrics server stopped")
+	}
+}
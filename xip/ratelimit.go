@@ -0,0 +1,282 @@
+package xip
+
+import (
+	"container/list"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"local-ip.sh/utils"
+)
+
+const (
+	rateLimitIpV4PrefixLength = 24
+	rateLimitIpV6PrefixLength = 56
+	// rateLimitMaxAccounts bounds the number of tracked accounts, the least
+	// recently used ones being forgotten to make room, so that floods of
+	// random names or spoofed networks can't exhaust memory.
+	rateLimitMaxAccounts = 100_000
+)
+
+// RateLimitConfig configures BIND-style response rate limiting. Responses
+// are accounted per client network and per kind of response, so that
+// identical responses can't be reflected at a victim and a single client
+// can't monopolize the server. Zero rates disable their limit.
+type RateLimitConfig struct {
+	// ResponsesPerSecond limits the responses with answers for a given name
+	// and type, as well as the NODATA ones.
+	ResponsesPerSecond int
+	// NxdomainsPerSecond limits the NXDOMAIN responses for the whole zone.
+	NxdomainsPerSecond int
+	// ErrorsPerSecond limits the REFUSED, FORMERR and SERVFAIL responses.
+	ErrorsPerSecond int
+	// AllPerSecond limits every response, whatever its kind.
+	AllPerSecond int
+	// Window is how far back the rates are measured, bounding how long a
+	// client stays limited after a burst.
+	Window time.Duration
+	// Slip sends a truncated response, inviting legitimate clients to retry
+	// over TCP, instead of dropping every Slip-th limited response. 0 drops
+	// them all, 1 never drops.
+	Slip int
+	// Exempt lists the networks that are never limited.
+	Exempt []netip.Prefix
+}
+
+// RateLimitStats counts the UDP responses that went through rate limiting.
+type RateLimitStats struct {
+	Allowed uint64
+	Dropped uint64
+	Slipped uint64
+}
+
+type rateLimitAction int
+
+const (
+	rateLimitAllow rateLimitAction = iota
+	rateLimitDrop
+	rateLimitSlip
+)
+
+type rateLimitKind int
+
+const (
+	rateLimitResponse rateLimitKind = iota
+	rateLimitNxdomain
+	rateLimitError
+	rateLimitAll
+)
+
+type rateLimitKey struct {
+	network netip.Prefix
+	kind    rateLimitKind
+	name    string
+	qtype   uint16
+}
+
+type rateLimitAccount struct {
+	key        rateLimitKey
+	balance    float64
+	lastUpdate time.Time
+	limited    int
+}
+
+type rateLimiter struct {
+	config      RateLimitConfig
+	mu          sync.Mutex
+	accounts    map[rateLimitKey]*list.Element
+	maxAccounts int
+	// recent orders the accounts from the most to the least recently used.
+	recent  *list.List
+	allowed atomic.Uint64
+	dropped atomic.Uint64
+	slipped atomic.Uint64
+}
+
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	if config.Window <= 0 {
+		config.Window = 15 * time.Second
+	}
+
+	return &rateLimiter{
+		config:      config,
+		accounts:    map[rateLimitKey]*list.Element{},
+		maxAccounts: rateLimitMaxAccounts,
+		recent:      list.New(),
+	}
+}
+
+// rateLimitFromConfig builds RateLimitConfig from the configuration, where
+// exemptions are validated CIDR prefixes.
+func rateLimitFromConfig() RateLimitConfig {
+	config := utils.GetConfig()
+	rateLimit := RateLimitConfig{
+		ResponsesPerSecond: config.RRLResponsesPerSecond,
+		NxdomainsPerSecond: config.RRLNxdomainsPerSecond,
+		ErrorsPerSecond:    config.RRLErrorsPerSecond,
+		AllPerSecond:       config.RRLAllPerSecond,
+		Window:             config.RRLWindow,
+		Slip:               config.RRLSlip,
+	}
+	for _, exempt := range config.RRLExempt {
+		prefix, err := netip.ParsePrefix(exempt)
+		if err == nil {
+			rateLimit.Exempt = append(rateLimit.Exempt, prefix.Masked())
+		}
+	}
+
+	return rateLimit
+}
+
+func (config RateLimitConfig) enabled() bool {
+	return config.ResponsesPerSecond > 0 || config.NxdomainsPerSecond > 0 || config.ErrorsPerSecond > 0 || config.AllPerSecond > 0
+}
+
+// check accounts for the response about to be sent to client and tells
+// whether it should be sent, dropped, or replaced by a truncated one.
+func (rl *rateLimiter) check(client net.Addr, message *dns.Msg) rateLimitAction {
+	network, ok := clientNetwork(client)
+	if !ok || rl.isExempt(network.Addr()) {
+		rl.allowed.Add(1)
+		return rateLimitAllow
+	}
+
+	key := rateLimitKey{network: network}
+	var rate int
+	switch {
+	case message.Rcode == dns.RcodeNameError:
+		key.kind = rateLimitNxdomain
+		rate = rl.config.NxdomainsPerSecond
+	case message.Rcode != dns.RcodeSuccess:
+		key.kind = rateLimitError
+		rate = rl.config.ErrorsPerSecond
+	default:
+		key.kind = rateLimitResponse
+		rate = rl.config.ResponsesPerSecond
+		if len(message.Question) == 1 {
+			key.name = strings.ToLower(message.Question[0].Name)
+			key.qtype = message.Question[0].Qtype
+		}
+	}
+
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	allKey := rateLimitKey{network: network, kind: rateLimitAll}
+	limitedByKind := rl.debit(key, rate, now)
+	limitedByAll := rl.debit(allKey, rl.config.AllPerSecond, now)
+	if !limitedByKind && !limitedByAll {
+		rl.allowed.Add(1)
+		return rateLimitAllow
+	}
+
+	// the account of a limit that wasn't exceeded may not exist, or gets its
+	// count of limited responses reset on every response
+	limitedKey := key
+	if !limitedByKind {
+		limitedKey = allKey
+	}
+	account := rl.accounts[limitedKey].Value.(*rateLimitAccount)
+	account.limited++
+	if rl.config.Slip > 0 && account.limited%rl.config.Slip == 0 {
+		rl.slipped.Add(1)
+		return rateLimitSlip
+	}
+
+	rl.dropped.Add(1)
+	return rateLimitDrop
+}
+
+// debit charges one response to the account of key, credited with rate
+// responses per second, and tells whether the account is over its limit.
+// Callers must hold mu.
+func (rl *rateLimiter) debit(key rateLimitKey, rate int, now time.Time) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	element, ok := rl.accounts[key]
+	if ok {
+		rl.recent.MoveToFront(element)
+	} else {
+		if rl.recent.Len() >= rl.maxAccounts {
+			oldest := rl.recent.Back()
+			rl.recent.Remove(oldest)
+			delete(rl.accounts, oldest.Value.(*rateLimitAccount).key)
+		}
+		element = rl.recent.PushFront(&rateLimitAccount{key: key, balance: float64(rate), lastUpdate: now})
+		rl.accounts[key] = element
+	}
+	account := element.Value.(*rateLimitAccount)
+
+	elapsed := now.Sub(account.lastUpdate).Seconds()
+	account.lastUpdate = now
+	account.balance = min(float64(rate), account.balance+elapsed*float64(rate))
+	account.balance = max(account.balance-1, -rl.config.Window.Seconds()*float64(rate))
+	if account.balance >= 0 {
+		account.limited = 0
+		return false
+	}
+
+	return true
+}
+
+func (rl *rateLimiter) isExempt(ip netip.Addr) bool {
+	for _, prefix := range rl.config.Exempt {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rl *rateLimiter) stats() RateLimitStats {
+	return RateLimitStats{
+		Allowed: rl.allowed.Load(),
+		Dropped: rl.dropped.Load(),
+		Slipped: rl.slipped.Load(),
+	}
+}
+
+// clientNetwork returns the network of client that gets accounted as one.
+func clientNetwork(client net.Addr) (netip.Prefix, bool) {
+	addrPort, err := netip.ParseAddrPort(client.String())
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+
+	ip := addrPort.Addr().Unmap()
+	if ip.Is4() {
+		return netip.PrefixFrom(ip, rateLimitIpV4PrefixLength).Masked(), true
+	}
+	return netip.PrefixFrom(ip, rateLimitIpV6PrefixLength).Masked(), true
+}
+
+// RateLimitStats returns the counters of response rate limiting, all zero
+// when it is disabled.
+func (xip *Xip) RateLimitStats() RateLimitStats {
+	if xip.rateLimiter == nil {
+		return RateLimitStats{}
+	}
+
+	return xip.rateLimiter.stats()
+}
+
+// slipResponse turns message into an empty truncated response, small enough
+// not to be worth reflecting, that makes legitimate clients retry over TCP.
+// The OPT record is kept for clients to keep using EDNS.
+func slipResponse(message *dns.Msg) {
+	message.Truncated = true
+	message.Answer = nil
+	message.Ns = nil
+	message.Extra = slices.DeleteFunc(message.Extra, func(rr dns.RR) bool {
+		return rr.Header().Rrtype != dns.TypeOPT
+	})
+}
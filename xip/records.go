@@ -12,7 +12,8 @@ type hardcodedRecord struct {
 	TXT   []string // => dns.TXT
 	MX    []*dns.MX
 	CNAME []string // => dns.CNAME
-	SRV   *dns.SRV
+	SRV   []*dns.SRV
+	CAA   []*dns.CAA
 }
 
 func initialRecords() map[string]hardcodedRecord {
@@ -29,11 +30,13 @@ func initialRecords() map[string]hardcodedRecord {
 			},
 		},
 		"_autodiscover._tcp.local-ip.sh.": {
-			SRV: &dns.SRV{
-				Priority: 0,
-				Weight:   0,
-				Port:     443,
-				Target:   "email.capsulecorp.dev.",
+			SRV: []*dns.SRV{
+				{
+					Priority: 0,
+					Weight:   0,
+					Port:     443,
+					Target:   "email.capsulecorp.dev.",
+				},
 			},
 		},
 		"autoconfig.local-ip.sh.": {
@@ -51,3 +54,45 @@ func initialRecords() map[string]hardcodedRecord {
 		},
 	}
 }
+
+func (record hardcodedRecord) isEmpty() bool {
+	return len(record.A) == 0 && len(record.AAAA) == 0 && len(record.TXT) == 0 && len(record.MX) == 0 &&
+		len(record.CNAME) == 0 && len(record.SRV) == 0 && len(record.CAA) == 0
+}
+
+// rrs converts the records of name into resource records.
+func (record hardcodedRecord) rrs(name string, ttls TTLs) []dns.RR {
+	header := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{
+			Ttl:    ttls.forRecord(name, rrtype),
+			Name:   name,
+			Rrtype: rrtype,
+			Class:  dns.ClassINET,
+		}
+	}
+
+	var rrs []dns.RR
+	for _, ip := range record.A {
+		rrs = append(rrs, &dns.A{Hdr: header(dns.TypeA), A: ip})
+	}
+	for _, ip := range record.AAAA {
+		rrs = append(rrs, &dns.AAAA{Hdr: header(dns.TypeAAAA), AAAA: ip})
+	}
+	for _, txt := range record.TXT {
+		rrs = append(rrs, &dns.TXT{Hdr: header(dns.TypeTXT), Txt: chunkBy(txt, 255)})
+	}
+	for _, mx := range record.MX {
+		rrs = append(rrs, &dns.MX{Hdr: header(dns.TypeMX), Preference: mx.Preference, Mx: mx.Mx})
+	}
+	for _, target := range record.CNAME {
+		rrs = append(rrs, &dns.CNAME{Hdr: header(dns.TypeCNAME), Target: target})
+	}
+	for _, srv := range record.SRV {
+		rrs = append(rrs, &dns.SRV{Hdr: header(dns.TypeSRV), Priority: srv.Priority, Weight: srv.Weight, Port: srv.Port, Target: srv.Target})
+	}
+	for _, caa := range record.CAA {
+		rrs = append(rrs, &dns.CAA{Hdr: header(dns.TypeCAA), Flag: caa.Flag, Tag: caa.Tag, Value: caa.Value})
+	}
+
+	return rrs
+}
@@ -0,0 +1,109 @@
+package xip
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// recordSet is an immutable snapshot of the served records, swapped as a
+// whole whenever they change so that lookups never take a lock. Besides the
+// records by name, it indexes the names of the zone by label, from the apex
+// down, to find empty non-terminals and wildcards in O(labels).
+type recordSet struct {
+	zone  string
+	names map[string]hardcodedRecord
+	apex  *recordNode
+}
+
+type recordNode struct {
+	records  hardcodedRecord
+	children map[string]*recordNode
+	// populated tells whether the node or one of its descendants has
+	// records, empty nodes don't exist as far as DNS is concerned.
+	populated bool
+}
+
+// newRecordSet indexes records, keyed by lowercased FQDN. Names outside of
+// zone are left out of the index, they can only be found by their exact
+// name.
+func newRecordSet(zone string, records map[string]hardcodedRecord) *recordSet {
+	zone = strings.ToLower(zone)
+	set := &recordSet{zone: zone, names: records, apex: &recordNode{}}
+	for name, entry := range records {
+		if !dns.IsSubDomain(zone, name) {
+			continue
+		}
+
+		node := set.apex
+		labels := dns.SplitDomainName(name)
+		for i := len(labels) - dns.CountLabel(zone) - 1; i >= 0; i-- {
+			child, ok := node.children[labels[i]]
+			if !ok {
+				child = &recordNode{}
+				if node.children == nil {
+					node.children = map[string]*recordNode{}
+				}
+				node.children[labels[i]] = child
+			}
+			node = child
+		}
+		node.records = entry
+	}
+	set.apex.populate()
+
+	return set
+}
+
+func (node *recordNode) populate() bool {
+	node.populated = !node.records.isEmpty()
+	for _, child := range node.children {
+		if child.populate() {
+			node.populated = true
+		}
+	}
+
+	return node.populated
+}
+
+// lookup returns the records of name, a lowercased FQDN, and whether it
+// exists, empty non-terminals included. Names that don't exist get the
+// records of the closest wildcard, if any (RFC 4592).
+func (set *recordSet) lookup(name string) (hardcodedRecord, bool) {
+	if records, ok := set.names[name]; ok && !records.isEmpty() {
+		return records, true
+	}
+
+	relative, ok := strings.CutSuffix(name, set.zone)
+	if !ok || (relative != "" && !strings.HasSuffix(relative, ".")) {
+		return hardcodedRecord{}, false
+	}
+	relative = strings.TrimSuffix(relative, ".")
+
+	node := set.apex
+	for relative != "" {
+		var label string
+		if i := strings.LastIndexByte(relative, '.'); i >= 0 {
+			label, relative = relative[i+1:], relative[:i]
+		} else {
+			label, relative = relative, ""
+		}
+
+		child, ok := node.children[label]
+		if !ok || !child.populated {
+			if wildcard, ok := node.children["*"]; ok && !wildcard.records.isEmpty() {
+				return wildcard.records, true
+			}
+			return hardcodedRecord{}, false
+		}
+		node = child
+	}
+
+	return node.records, node.populated
+}
+
+// records returns the records of name, see lookup.
+func (set *recordSet) records(name string) hardcodedRecord {
+	records, _ := set.lookup(name)
+	return records
+}
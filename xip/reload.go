@@ -0,0 +1,157 @@
+package xip
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"local-ip.sh/utils"
+)
+
+// reloadDebounce groups the burst of events editors emit when saving a file.
+const reloadDebounce = 500 * time.Millisecond
+
+// ReloadStaticRecords reads the static records again and swaps them in if
+// they are valid. The records being served are left untouched otherwise.
+func (xip *Xip) ReloadStaticRecords() error {
+	staticRecords, err := xip.readStaticRecords()
+	if err != nil {
+		return err
+	}
+
+	xip.recordsMu.Lock()
+	if err := xip.checkStaticRecords(staticRecords); err != nil {
+		xip.recordsMu.Unlock()
+		return err
+	}
+	previousRecords := xip.staticRecords
+	xip.staticRecords = staticRecords
+	xip.rebuildRecords()
+	xip.recordsMu.Unlock()
+
+	added, removed := diffRecords(previousRecords, staticRecords)
+	for _, record := range added {
+		utils.Logger.Info().Str("record", record).Msg("Added static record")
+	}
+	for _, record := range removed {
+		utils.Logger.Info().Str("record", record).Msg("Removed static record")
+	}
+	utils.Logger.Info().Int("added", len(added)).Int("removed", len(removed)).Msg("Reloaded static records")
+	return nil
+}
+
+// WatchStaticRecords reloads the static records on SIGHUP and whenever the
+// zone file changes, until ctx is done.
+func (xip *Xip) WatchStaticRecords(ctx context.Context) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	var fileEvents chan fsnotify.Event
+	if xip.zoneFile != "" {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			utils.Logger.Error().Err(err).Msg("Failed to watch zone file, only reloading on SIGHUP")
+		} else {
+			defer watcher.Close()
+			// watch the directory rather than the file to keep up with editors
+			// replacing it instead of writing to it
+			err = watcher.Add(filepath.Dir(xip.zoneFile))
+			if err != nil {
+				utils.Logger.Error().Err(err).Msg("Failed to watch zone file, only reloading on SIGHUP")
+			}
+			fileEvents = watcher.Events
+		}
+	}
+
+	// Kubernetes updates ConfigMap volumes by swapping the ..data symlink the
+	// zone file resolves through, events are then about ..data only
+	resolved, _ := filepath.EvalSymlinks(xip.zoneFile)
+
+	debounce := time.NewTimer(reloadDebounce)
+	debounce.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+			utils.Logger.Info().Msg("Received SIGHUP, reloading static records")
+			xip.reloadStaticRecords()
+		case event := <-fileEvents:
+			if event.Has(fsnotify.Chmod) {
+				continue
+			}
+			if filepath.Clean(event.Name) == filepath.Clean(xip.zoneFile) {
+				debounce.Reset(reloadDebounce)
+			} else if target, err := filepath.EvalSymlinks(xip.zoneFile); err == nil && target != resolved {
+				resolved = target
+				debounce.Reset(reloadDebounce)
+			}
+		case <-debounce.C:
+			utils.Logger.Info().Str("zone_file", xip.zoneFile).Msg("Zone file changed, reloading static records")
+			xip.reloadStaticRecords()
+		}
+	}
+}
+
+func (xip *Xip) reloadStaticRecords() {
+	err := xip.ReloadStaticRecords()
+	if err != nil {
+		utils.Logger.Error().Err(err).Str("zone_file", xip.zoneFile).Msg("Failed to reload static records, keeping the current ones")
+	}
+}
+
+// diffRecords lists the records, in presentation format, that are only in
+// next and only in previous.
+func diffRecords(previous map[string]hardcodedRecord, next map[string]hardcodedRecord) (added []string, removed []string) {
+	previousRecords := describeRecords(previous)
+	nextRecords := describeRecords(next)
+	for _, record := range nextRecords {
+		if _, found := slices.BinarySearch(previousRecords, record); !found {
+			added = append(added, record)
+		}
+	}
+	for _, record := range previousRecords {
+		if _, found := slices.BinarySearch(nextRecords, record); !found {
+			removed = append(removed, record)
+		}
+	}
+
+	return added, removed
+}
+
+func describeRecords(records map[string]hardcodedRecord) []string {
+	var descriptions []string
+	for name, entry := range records {
+		for _, ip := range entry.A {
+			descriptions = append(descriptions, fmt.Sprintf("%s A %s", name, ip))
+		}
+		for _, ip := range entry.AAAA {
+			descriptions = append(descriptions, fmt.Sprintf("%s AAAA %s", name, ip))
+		}
+		for _, txt := range entry.TXT {
+			descriptions = append(descriptions, fmt.Sprintf("%s TXT %q", name, txt))
+		}
+		for _, mx := range entry.MX {
+			descriptions = append(descriptions, fmt.Sprintf("%s MX %d %s", name, mx.Preference, mx.Mx))
+		}
+		for _, target := range entry.CNAME {
+			descriptions = append(descriptions, fmt.Sprintf("%s CNAME %s", name, target))
+		}
+		for _, srv := range entry.SRV {
+			descriptions = append(descriptions, fmt.Sprintf("%s SRV %d %d %d %s", name, srv.Priority, srv.Weight, srv.Port, srv.Target))
+		}
+		for _, caa := range entry.CAA {
+			descriptions = append(descriptions, fmt.Sprintf("%s CAA %d %s %q", name, caa.Flag, caa.Tag, caa.Value))
+		}
+	}
+
+	slices.Sort(descriptions)
+	return slices.Compact(descriptions)
+}
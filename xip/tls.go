@@ -0,0 +1,68 @@
+package xip
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// CertificateSource provides the certificate presented to TLS clients, such
+// as http.CertificateReloader which picks up renewed certificates.
+type CertificateSource interface {
+	GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// WithTLSCertificates sets the certificates of the TLS listeners: root for
+// the domain itself and wildcard for its subdomains, nameservers included.
+func WithTLSCertificates(root CertificateSource, wildcard CertificateSource) Option {
+	return func(x *Xip) {
+		x.rootCertificate = root
+		x.wildcardCertificate = wildcard
+	}
+}
+
+// WithDotPort serves DNS over TLS (RFC 7858) on port, 0 disabling it. It
+// requires WithTLSCertificates.
+func WithDotPort(port uint) Option {
+	return func(x *Xip) {
+		x.dotPort = port
+	}
+}
+
+func (xip *Xip) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: xip.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// getCertificate picks the wildcard certificate for the subdomains clients
+// ask for through SNI, and the root certificate otherwise.
+func (xip *Xip) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if xip.rootCertificate == nil || xip.wildcardCertificate == nil {
+		return nil, errors.New("no TLS certificates configured")
+	}
+
+	if strings.HasSuffix(strings.ToLower(hello.ServerName), "."+xip.domain) {
+		return xip.wildcardCertificate.GetCertificate(hello)
+	}
+	return xip.rootCertificate.GetCertificate(hello)
+}
+
+// transport names how response reaches the client: "udp", "tcp", "tls",
+// "https", or "quic".
+func transport(response dns.ResponseWriter) string {
+	switch response.(type) {
+	case *dohResponseWriter:
+		return "https"
+	case *doqResponseWriter:
+		return "quic"
+	}
+	if stater, ok := response.(dns.ConnectionStater); ok && stater.ConnectionState() != nil {
+		return "tls"
+	}
+
+	return response.LocalAddr().Network()
+}
@@ -0,0 +1,236 @@
+package xip
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"local-ip.sh/utils"
+)
+
+const (
+	notifyAttempts = 3
+	notifyTimeout  = 5 * time.Second
+)
+
+type tsigKey struct {
+	name   string
+	secret string
+}
+
+// parseTsigKey parses a TSIG key in the "name:base64 secret" format. Keys
+// always use HMAC-SHA256.
+func parseTsigKey(key string) (*tsigKey, error) {
+	name, secret, found := strings.Cut(key, ":")
+	if !found || name == "" || secret == "" {
+		return nil, fmt.Errorf("invalid TSIG key, expected name:secret")
+	}
+
+	return &tsigKey{dns.CanonicalName(name), secret}, nil
+}
+
+// tsigProvider signs and verifies messages with the TSIG key, nil without
+// one.
+func (xip *Xip) tsigProvider() dns.TsigProvider {
+	if xip.tsigKey == nil {
+		return nil
+	}
+
+	return xip.tsigKey
+}
+
+// Generate computes the HMAC-SHA256 of msg. Key names are domain names, so
+// messages naming the key in any case are signed.
+func (key *tsigKey) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	if dns.CanonicalName(t.Hdr.Name) != key.name {
+		return nil, dns.ErrSecret
+	}
+	if dns.CanonicalName(t.Algorithm) != dns.HmacSHA256 {
+		return nil, dns.ErrKeyAlg
+	}
+	secret, err := base64.StdEncoding.DecodeString(key.secret)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hmac.New(sha256.New, secret)
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+// Verify checks the MAC of t against msg.
+func (key *tsigKey) Verify(msg []byte, t *dns.TSIG) error {
+	expected, err := key.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expected, mac) {
+		return dns.ErrSig
+	}
+
+	return nil
+}
+
+// isTransfer tells whether request asks for a zone transfer.
+func isTransfer(request *dns.Msg) bool {
+	return len(request.Question) == 1 && (request.Question[0].Qtype == dns.TypeAXFR || request.Question[0].Qtype == dns.TypeIXFR)
+}
+
+// handleTransfer answers AXFR and IXFR requests from the configured
+// secondaries, when signed with the configured TSIG key. We don't keep the
+// history of the zone so IXFR falls back to a full transfer unless the
+// secondary is already up to date.
+func (xip *Xip) handleTransfer(response dns.ResponseWriter, request *dns.Msg) {
+	defer response.Close()
+
+	message := new(dns.Msg)
+	message.SetReply(request)
+	if rcode := xip.checkTransfer(response, request); rcode != dns.RcodeSuccess {
+		utils.Logger.Info().Str("remote_address", response.RemoteAddr().String()).Str("rcode", dns.RcodeToString[rcode]).Msg("Refused zone transfer")
+		message.Rcode = rcode
+		response.WriteMsg(message)
+		return
+	}
+
+	records := xip.zoneRecords()
+	soa := records[0]
+	if request.Question[0].Qtype == dns.TypeIXFR {
+		for _, record := range request.Ns {
+			if clientSoa, ok := record.(*dns.SOA); ok && clientSoa.Serial == soa.(*dns.SOA).Serial {
+				records = []dns.RR{soa}
+			}
+		}
+	}
+	if len(records) > 1 {
+		records = append(records, soa)
+	}
+
+	transfer := &dns.Transfer{TsigProvider: xip.tsigProvider()}
+	envelopes := make(chan *dns.Envelope)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := transfer.Out(response, request, envelopes)
+		if err != nil {
+			utils.Logger.Error().Err(err).Str("remote_address", response.RemoteAddr().String()).Msg("Zone transfer failed")
+		}
+	}()
+	for chunk := range slices.Chunk(records, 100) {
+		envelopes <- &dns.Envelope{RR: chunk}
+	}
+	close(envelopes)
+	wg.Wait()
+
+	utils.Logger.Info().Str("remote_address", response.RemoteAddr().String()).Str("type", dns.TypeToString[request.Question[0].Qtype]).Int("records", len(records)).Msg("Transferred zone")
+}
+
+func (xip *Xip) checkTransfer(response dns.ResponseWriter, request *dns.Msg) int {
+	if response.LocalAddr().Network() != "tcp" || xip.tsigKey == nil || !strings.EqualFold(request.Question[0].Name, xip.zone()) {
+		return dns.RcodeRefused
+	}
+
+	host, _, err := net.SplitHostPort(response.RemoteAddr().String())
+	if err != nil || !xip.isSecondary(net.ParseIP(host)) {
+		return dns.RcodeRefused
+	}
+
+	tsig := request.IsTsig()
+	if tsig == nil || dns.CanonicalName(tsig.Hdr.Name) != xip.tsigKey.name {
+		return dns.RcodeRefused
+	}
+	if response.TsigStatus() != nil {
+		return dns.RcodeNotAuth
+	}
+
+	return dns.RcodeSuccess
+}
+
+func (xip *Xip) isSecondary(ip net.IP) bool {
+	for _, secondary := range xip.secondaries {
+		host, _, err := net.SplitHostPort(secondary)
+		if err != nil {
+			host = secondary
+		}
+		if ip.Equal(net.ParseIP(host)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// zoneRecords lists every record of the zone, starting with the SOA record,
+// for zone transfers. Synthesized records can't be listed and are left out.
+func (xip *Xip) zoneRecords() []dns.RR {
+	soa := xip.soaRecord(dns.Question{Name: xip.zone(), Qtype: dns.TypeSOA, Qclass: dns.ClassINET})
+	records := []dns.RR{soa}
+	for _, ns := range xip.nameServers {
+		records = append(records, &dns.NS{
+			Hdr: dns.RR_Header{
+				Ttl:    xip.ttls.forRecord(xip.zone(), dns.TypeNS),
+				Name:   xip.zone(),
+				Rrtype: dns.TypeNS,
+				Class:  dns.ClassINET,
+			},
+			Ns: ns,
+		})
+	}
+
+	snapshot := xip.records.Load()
+	names := make([]string, 0, len(snapshot.names))
+	for name := range snapshot.names {
+		// the built-in records are for local-ip.sh whatever the domain
+		if dns.IsSubDomain(xip.zone(), name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		records = append(records, snapshot.names[name].rrs(name, xip.ttls)...)
+	}
+
+	return records
+}
+
+// notifySecondaries tells the secondaries that the zone changed so that they
+// transfer it again without waiting for the SOA refresh timer.
+func (xip *Xip) notifySecondaries() {
+	for _, secondary := range xip.secondaries {
+		address := secondary
+		if _, _, err := net.SplitHostPort(secondary); err != nil {
+			address = net.JoinHostPort(secondary, "53")
+		}
+
+		go func() {
+			message := new(dns.Msg)
+			message.SetNotify(xip.zone())
+			if xip.tsigKey != nil {
+				message.SetTsig(xip.tsigKey.name, dns.HmacSHA256, 300, time.Now().Unix())
+			}
+			client := &dns.Client{Timeout: notifyTimeout, TsigProvider: xip.tsigProvider()}
+
+			var err error
+			for range notifyAttempts {
+				_, _, err = client.Exchange(message, address)
+				if err == nil {
+					utils.Logger.Debug().Str("secondary", address).Msg("Notified secondary")
+					return
+				}
+			}
+			utils.Logger.Error().Err(err).Str("secondary", address).Msg("Failed to notify secondary")
+		}()
+	}
+}
@@ -0,0 +1,129 @@
+package xip
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"local-ip.sh/utils"
+)
+
+// TTLs holds the TTLs of the answers. Zero durations fall back to the
+// defaults below.
+type TTLs struct {
+	// Default applies to every record without a more specific TTL.
+	Default time.Duration
+	// Synthesized applies to the A and AAAA records derived from the queried
+	// name, which never change.
+	Synthesized time.Duration
+	// Types overrides Default for static records of a given type.
+	Types map[uint16]time.Duration
+	// Names overrides Types and Default for every static record of a name,
+	// keyed by lowercased FQDN.
+	Names map[string]time.Duration
+
+	SOARefresh time.Duration
+	SOARetry   time.Duration
+	SOAExpire  time.Duration
+	// SOAMinimum is how long resolvers cache negative answers.
+	SOAMinimum time.Duration
+}
+
+var defaultTTLs = TTLs{
+	Default:    5 * time.Minute,
+	SOARefresh: 15 * time.Minute,
+	SOARetry:   15 * time.Minute,
+	SOAExpire:  30 * time.Minute,
+	SOAMinimum: 5 * time.Minute,
+}
+
+// withDefaults fills the zero durations of ttls with the default ones.
+func (ttls TTLs) withDefaults() TTLs {
+	if ttls.Default == 0 {
+		ttls.Default = defaultTTLs.Default
+	}
+	if ttls.SOARefresh == 0 {
+		ttls.SOARefresh = defaultTTLs.SOARefresh
+	}
+	if ttls.SOARetry == 0 {
+		ttls.SOARetry = defaultTTLs.SOARetry
+	}
+	if ttls.SOAExpire == 0 {
+		ttls.SOAExpire = defaultTTLs.SOAExpire
+	}
+	if ttls.SOAMinimum == 0 {
+		ttls.SOAMinimum = defaultTTLs.SOAMinimum
+	}
+
+	return ttls
+}
+
+// forRecord returns the TTL of the static records of type rrtype at name.
+func (ttls TTLs) forRecord(name string, rrtype uint16) uint32 {
+	if ttl, ok := ttls.Names[strings.ToLower(name)]; ok {
+		return seconds(ttl)
+	}
+
+	return ttls.forType(rrtype)
+}
+
+// forSynthesized returns the TTL of the records of type rrtype derived from
+// the queried name.
+func (ttls TTLs) forSynthesized(rrtype uint16) uint32 {
+	if ttls.Synthesized != 0 {
+		return seconds(ttls.Synthesized)
+	}
+
+	return ttls.forType(rrtype)
+}
+
+func (ttls TTLs) forType(rrtype uint16) uint32 {
+	if ttl, ok := ttls.Types[rrtype]; ok {
+		return seconds(ttl)
+	}
+
+	return seconds(ttls.Default)
+}
+
+func seconds(duration time.Duration) uint32 {
+	return uint32(duration.Seconds())
+}
+
+// ttlsFromConfig builds TTLs from the configuration, where types are named
+// like "TXT" and names are relative to the domain, "@" being the apex.
+func ttlsFromConfig() TTLs {
+	config := utils.GetConfig()
+	zone := fmt.Sprintf("%s.", config.Domain)
+	ttls := TTLs{
+		Default:     config.TTL,
+		Synthesized: config.SynthesizedTTL,
+		Types:       map[uint16]time.Duration{},
+		Names:       map[string]time.Duration{},
+		SOARefresh:  config.SOARefresh,
+		SOARetry:    config.SOARetry,
+		SOAExpire:   config.SOAExpire,
+		SOAMinimum:  config.SOAMinimum,
+	}
+	for rrtype, ttl := range config.TypeTTLs {
+		ttls.Types[dns.StringToType[strings.ToUpper(rrtype)]] = ttl
+	}
+	for name, ttl := range config.NameTTLs {
+		ttls.Names[absoluteName(name, zone)] = ttl
+	}
+
+	return ttls
+}
+
+// absoluteName resolves name relative to zone, like names of a zone file.
+func absoluteName(name string, zone string) string {
+	name = strings.ToLower(name)
+	switch {
+	case name == "@":
+		return zone
+	case dns.IsFqdn(name):
+		return name
+	default:
+		return name + "." + zone
+	}
+}
@@ -0,0 +1,118 @@
+package xip
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	workersPerCpu       = 8
+	defaultQueryTimeout = 2 * time.Second
+	packBufferSize      = 4096
+)
+
+// dropOverloaded is the reason for dropping queries that found no free
+// worker, either right away because too many queries were already waiting
+// for one, or before their deadline.
+const dropOverloaded = "overloaded"
+
+// WithWorkers bounds how many queries are answered concurrently, defaults
+// to 8 per CPU.
+func WithWorkers(workers int) Option {
+	return func(x *Xip) {
+		x.workers = workers
+	}
+}
+
+// WithQueryTimeout sets how long a query can wait for a worker before being
+// dropped, past which the client has most likely given up on it.
+func WithQueryTimeout(timeout time.Duration) Option {
+	return func(x *Xip) {
+		x.queryTimeout = timeout
+	}
+}
+
+// workerPool bounds how many queries are answered concurrently, over every
+// transport. Queries are answered by the handler goroutine of the server that
+// received them once they get a worker, so that servers shutting down wait
+// for them. Servers don't stop reading queries when workers are busy, UDP
+// ones start a goroutine for each, so only as many queries as there are
+// workers can wait for one, the others are dropped right away.
+type workerPool struct {
+	workers chan struct{}
+	waiting chan struct{}
+}
+
+func newWorkerPool(workers int) *workerPool {
+	return &workerPool{
+		workers: make(chan struct{}, workers),
+		waiting: make(chan struct{}, workers),
+	}
+}
+
+// acquire waits for a free worker until deadline, unless too many queries
+// are already waiting. It reports whether it got one, which must then be
+// released.
+func (p *workerPool) acquire(deadline time.Time) bool {
+	select {
+	case p.workers <- struct{}{}:
+		return true
+	default:
+	}
+
+	select {
+	case p.waiting <- struct{}{}:
+		defer func() { <-p.waiting }()
+	default:
+		return false
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case p.workers <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (p *workerPool) release() {
+	<-p.workers
+}
+
+func defaultWorkers() int {
+	return workersPerCpu * runtime.GOMAXPROCS(0)
+}
+
+var packBuffers = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, packBufferSize)
+		return &buffer
+	},
+}
+
+// writeMsg writes message like response.WriteMsg, packing it in a pooled
+// buffer when nothing else needs to be done with it. TSIG signed responses
+// and the DNS over HTTPS and QUIC writers go through WriteMsg.
+func writeMsg(response dns.ResponseWriter, request *dns.Msg, message *dns.Msg) error {
+	switch response.(type) {
+	case *dohResponseWriter, *doqResponseWriter:
+		return response.WriteMsg(message)
+	}
+	if request.IsTsig() != nil {
+		return response.WriteMsg(message)
+	}
+
+	buffer := packBuffers.Get().(*[]byte)
+	defer packBuffers.Put(buffer)
+	packed, err := message.PackBuffer(*buffer)
+	if err != nil {
+		return err
+	}
+	_, err = response.Write(packed)
+	return err
+}
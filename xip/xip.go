@@ -1,12 +1,16 @@
 package xip
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -14,17 +18,62 @@ import (
 )
 
 type Xip struct {
-	server      dns.Server
-	nameServers []string
-	domain      string
-	email       string
-	dnsPort     uint
-	recordsMu   sync.RWMutex
-	records     map[string]hardcodedRecord
+	servers       []dnsServer
+	nameServers   []string
+	domain        string
+	email         string
+	dnsPort       uint
+	dnsSockets    int
+	dnsListen     []string
+	dnsTcpListen  []string
+	ednsUdpSize   uint16
+	zoneFile      string
+	dnssecKeysDir string
+	secondaries   []string
+	tsigKey       *tsigKey
+	ttls          TTLs
+	anyResponse   string
+	caaIssuer     string
+	caaPinAccount bool
+	caaAccountURI string
+	rateLimiter   *rateLimiter
+	metrics       *metrics
+	dnstap        *dnstapLogger
+	dotPort       uint
+	doqPort       uint
+	doqMaxStreams int64
+	mux           *dns.ServeMux
+	workers       int
+	queryTimeout  time.Duration
+	pool          *workerPool
+	chaosRecords  map[string]string
+	nsid          string
+	// rootCertificate and wildcardCertificate are presented by the TLS
+	// listeners, see getCertificate.
+	rootCertificate     CertificateSource
+	wildcardCertificate CertificateSource
+	serial              atomic.Uint32
+	ksk                 *dnssecKey
+	zsk                 *dnssecKey
+	// recordsMu serializes the changes of the records, lookups don't take
+	// it and go through the snapshot of records instead.
+	recordsMu sync.Mutex
+	// inflight tracks the queries being answered, for graceful shutdowns.
+	inflight inflightQueries
+	// records is what gets served: the static records, loaded from the zone
+	// file, merged with the dynamic ones derived from the configuration and
+	// the ACME challenges.
+	records        atomic.Pointer[recordSet]
+	staticRecords  map[string]hardcodedRecord
+	dynamicRecords map[string]hardcodedRecord
 }
 
 type Option func(*Xip)
 
+// ShutdownTimeout bounds how long shutting down waits for servers and
+// queries in flight.
+const ShutdownTimeout = 5 * time.Second
+
 func WithDomain(domain string) Option {
 	return func(x *Xip) {
 		x.domain = domain
@@ -43,6 +92,134 @@ func WithDnsPort(port uint) Option {
 	}
 }
 
+// WithDnsListen serves DNS on addresses, "host:port" pairs such as
+// "192.0.2.1:53" or "[2001:db8::1]:53", instead of every interface on the
+// DNS port.
+func WithDnsListen(addresses []string) Option {
+	return func(x *Xip) {
+		x.dnsListen = addresses
+	}
+}
+
+// WithDnsTcpListen serves DNS over TCP, and DNS over TLS on the same hosts,
+// on addresses instead of those of WithDnsListen, for hosts such as Fly.io
+// only routing UDP to the address UDP has to listen on.
+func WithDnsTcpListen(addresses []string) Option {
+	return func(x *Xip) {
+		x.dnsTcpListen = addresses
+	}
+}
+
+// WithDnsSockets sets how many UDP and TCP sockets listen on the DNS port,
+// each read by its own goroutine, sharing the port with SO_REUSEPORT when
+// there are several. It defaults to GOMAXPROCS.
+func WithDnsSockets(sockets int) Option {
+	return func(x *Xip) {
+		x.dnsSockets = sockets
+	}
+}
+
+func WithEdnsUdpSize(size uint16) Option {
+	return func(x *Xip) {
+		x.ednsUdpSize = size
+	}
+}
+
+// WithZoneFile serves the static records of the RFC 1035 zone file at path
+// instead of the built-in ones.
+func WithZoneFile(path string) Option {
+	return func(x *Xip) {
+		x.zoneFile = path
+	}
+}
+
+// WithDnssecKeysDir enables DNSSEC, signing answers with the keys stored in
+// dir. Missing keys are generated on startup.
+func WithDnssecKeysDir(dir string) Option {
+	return func(x *Xip) {
+		x.dnssecKeysDir = dir
+	}
+}
+
+// WithSecondaries allows zone transfers to the secondary nameservers at
+// addresses, given as "ip" or "ip:port", and notifies them of changes.
+func WithSecondaries(addresses []string) Option {
+	return func(x *Xip) {
+		x.secondaries = addresses
+	}
+}
+
+// WithTsigKey sets the HMAC-SHA256 key, in the "name:base64 secret"
+// format, that secondaries must sign zone transfers with.
+func WithTsigKey(key string) Option {
+	return func(x *Xip) {
+		tsigKey, err := parseTsigKey(key)
+		if err != nil {
+			utils.Logger.Fatal().Err(err).Msg("Invalid TSIG key")
+		}
+		x.tsigKey = tsigKey
+	}
+}
+
+func WithTTLs(ttls TTLs) Option {
+	return func(x *Xip) {
+		x.ttls = ttls
+	}
+}
+
+const (
+	// AnyResponseHinfo answers every ANY query with a synthesized HINFO.
+	AnyResponseHinfo = "hinfo"
+	// AnyResponseTCP answers ANY queries over TCP with every record of the
+	// name, and the ones over UDP with a synthesized HINFO.
+	AnyResponseTCP = "tcp"
+)
+
+func WithAnyResponse(mode string) Option {
+	return func(x *Xip) {
+		x.anyResponse = mode
+	}
+}
+
+// WithCAAIssuer publishes CAA records allowing only the CA identified by
+// issuer, such as "letsencrypt.org", to issue certificates for the zone.
+func WithCAAIssuer(issuer string) Option {
+	return func(x *Xip) {
+		x.caaIssuer = issuer
+	}
+}
+
+// WithCAAAccountPinning restricts the CAA records to the ACME account set
+// with SetCAAAccountURI.
+func WithCAAAccountPinning(pin bool) Option {
+	return func(x *Xip) {
+		x.caaPinAccount = pin
+	}
+}
+
+// WithRateLimit limits the rate of UDP responses sent to each client
+// network as configured.
+func WithRateLimit(config RateLimitConfig) Option {
+	return func(x *Xip) {
+		x.rateLimiter = nil
+		if config.enabled() {
+			x.rateLimiter = newRateLimiter(config)
+		}
+	}
+}
+
+// WithDnstap emits dnstap messages of the queries and responses to target,
+// "unix:/path/to/socket" or "file:/path/to/file".
+func WithDnstap(target string) Option {
+	return func(x *Xip) {
+		dnstap, err := newDnstapLogger(target)
+		if err != nil {
+			utils.Logger.Fatal().Err(err).Msg("Failed to start dnstap output")
+		}
+		x.dnstap = dnstap
+	}
+}
+
 func WithNameServers(nameServers []string) Option {
 	return func(x *Xip) {
 		x.recordsMu.Lock()
@@ -51,9 +228,9 @@ func WithNameServers(nameServers []string) Option {
 			name := fmt.Sprintf("ns%d.%s.", i+1, x.domain)
 			ip := net.ParseIP(ns)
 
-			entry := x.records[name]
+			entry := x.dynamicRecords[name]
 			entry.A = append(entry.A, ip)
-			x.records[name] = entry
+			x.dynamicRecords[name] = entry
 
 			x.nameServers = append(x.nameServers, name)
 		}
@@ -62,8 +239,7 @@ func WithNameServers(nameServers []string) Option {
 
 var (
 	flyRegion          = os.Getenv("FLY_REGION")
-	dottedIpV4Regex    = regexp.MustCompile(`(?:^|(?:[\w\d])+\.)(((25[0-5]|(2[0-4]|1\d|[1-9]|)\d)\.?\b){4})($|[.-])`)
-	dashedIpV4Regex    = regexp.MustCompile(`(?:^|(?:[\w\d])+\.)(((25[0-5]|(2[0-4]|1\d|[1-9]|)\d)\-?\b){4})($|[.-])`)
+	dashedIpV6Regex    = regexp.MustCompile(`^[0-9a-f]{0,4}(-[0-9a-f]{0,4}){2,7}$`)
 	anyWhitespaceRegex = regexp.MustCompile(`\s`)
 )
 
@@ -76,9 +252,10 @@ func (xip *Xip) SetTXTRecord(fqdn string, value string) {
 
 	xip.recordsMu.Lock()
 	defer xip.recordsMu.Unlock()
-	if rootRecords, ok := xip.records[fqdn]; ok {
+	if rootRecords, ok := xip.dynamicRecords[fqdn]; ok {
 		rootRecords.TXT = []string{value}
-		xip.records[fmt.Sprintf("_acme-challenge.%s.", xip.domain)] = rootRecords
+		xip.dynamicRecords[fmt.Sprintf("_acme-challenge.%s.", xip.domain)] = rootRecords
+		xip.rebuildRecords()
 	}
 }
 
@@ -91,24 +268,30 @@ func (xip *Xip) UnsetTXTRecord(fqdn string) {
 
 	xip.recordsMu.Lock()
 	defer xip.recordsMu.Unlock()
-	if rootRecords, ok := xip.records[fqdn]; ok {
+	if rootRecords, ok := xip.dynamicRecords[fqdn]; ok {
 		rootRecords.TXT = []string{}
-		xip.records[fmt.Sprintf("_acme-challenge.%s.", xip.domain)] = rootRecords
+		xip.dynamicRecords[fmt.Sprintf("_acme-challenge.%s.", xip.domain)] = rootRecords
+		xip.rebuildRecords()
 	}
 }
 
 func (xip *Xip) fqdnToA(fqdn string) []*dns.A {
+	aRecords, _ := xip.resolveA(fqdn)
+	return aRecords
+}
+
+// resolveA returns the A records of fqdn along with the encoding they were
+// found with.
+func (xip *Xip) resolveA(fqdn string) ([]*dns.A, string) {
 	normalizedFqdn := strings.ToLower(fqdn)
-	xip.recordsMu.RLock()
-	records := xip.records[normalizedFqdn].A
-	xip.recordsMu.RUnlock()
+	records := xip.records.Load().records(normalizedFqdn).A
 	if records != nil {
 		var aRecords []*dns.A
 
 		for _, record := range records {
 			aRecords = append(aRecords, &dns.A{
 				Hdr: dns.RR_Header{
-					Ttl:    uint32((time.Minute * 5).Seconds()),
+					Ttl:    xip.ttls.forRecord(fqdn, dns.TypeA),
 					Name:   fqdn,
 					Rrtype: dns.TypeA,
 					Class:  dns.ClassINET,
@@ -117,43 +300,257 @@ func (xip *Xip) fqdnToA(fqdn string) []*dns.A {
 			})
 		}
 
-		return aRecords
+		return aRecords, encodingStatic
+	}
+
+	ipV4Address, encoding := findSeparatedIpV4(fqdn, '-', encodingDashed)
+	if ipV4Address == nil {
+		ipV4Address, encoding = findSeparatedIpV4(fqdn, '.', encodingDotted)
+	}
+	// the labels are walked rather than split to spare an allocation per query
+	subdomain := xip.subdomain(normalizedFqdn)
+	for ipV4Address == nil && subdomain != "" {
+		var label string
+		label, subdomain, _ = strings.Cut(subdomain, ".")
+		ipV4Address, encoding = parseIntegerIpV4(label)
+	}
+	if ipV4Address != nil {
+		return []*dns.A{{
+			Hdr: dns.RR_Header{
+				Ttl:    xip.ttls.forSynthesized(dns.TypeA),
+				Name:   fqdn,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+			},
+			A: ipV4Address,
+		}}, encoding
+	}
+
+	return nil, encodingNone
+}
+
+// findSeparatedIpV4 finds the first IPv4 address of fqdn written with
+// separator between its octets, starting a label and followed by the end of
+// the name, a dot or a dash, such as "192-168-1-29" in
+// "app.192-168-1-29-foo.local-ip.sh". Octets are written without leading
+// zeros.
+func findSeparatedIpV4(fqdn string, separator byte, encoding string) (net.IP, string) {
+	for start := range len(fqdn) {
+		if !startsAddressLabel(fqdn, start) {
+			continue
+		}
+		if ipV4Address := parseSeparatedIpV4(fqdn[start:], separator); ipV4Address != nil {
+			return ipV4Address, encoding
+		}
 	}
 
-	for _, ipV4RE := range []*regexp.Regexp{dashedIpV4Regex, dottedIpV4Regex} {
-		if ipV4RE.MatchString(fqdn) {
-			match := ipV4RE.FindStringSubmatch(fqdn)[1]
-			match = strings.ReplaceAll(match, "-", ".")
-			ipV4Address := net.ParseIP(match).To4()
-			if ipV4Address == nil {
+	return nil, encodingNone
+}
+
+// parseSeparatedIpV4 parses the IPv4 address at the start of s.
+func parseSeparatedIpV4(s string, separator byte) net.IP {
+	var octets [4]byte
+	i := 0
+	for octet := range octets {
+		if octet > 0 {
+			if i >= len(s) || s[i] != separator {
 				return nil
 			}
+			i++
+		}
+
+		start := i
+		value := 0
+		for i < len(s) && isDigit(s[i]) && i-start < 3 {
+			value = value*10 + int(s[i]-'0')
+			i++
+		}
+		digits := i - start
+		if digits == 0 || (i < len(s) && isDigit(s[i])) || (digits > 1 && s[start] == '0') || value > 255 {
+			return nil
+		}
+		octets[octet] = byte(value)
+	}
+	if i < len(s) && s[i] != '.' && s[i] != '-' {
+		return nil
+	}
+
+	return net.IP{octets[0], octets[1], octets[2], octets[3]}
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || ('a' <= c && c <= 'f')
+}
+
+func isWordChar(c byte) bool {
+	return isDigit(c) || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || c == '_'
+}
+
+// startsAddressLabel tells whether an address can start at index start of
+// name: at the start of the name, or at the start of a label following one
+// that ends with a word character, like "app." in "app.192-168-1-29". Both
+// IPv4 and IPv6 addresses follow this rule.
+func startsAddressLabel(name string, start int) bool {
+	return start == 0 || (start >= 2 && name[start-1] == '.' && isWordChar(name[start-2]))
+}
+
+// subdomain returns normalizedFqdn without the zone and the trailing dot.
+func (xip *Xip) subdomain(normalizedFqdn string) string {
+	subdomain := strings.TrimSuffix(normalizedFqdn, ".")
+	if parent, found := strings.CutSuffix(subdomain, xip.domain); found && strings.HasSuffix(parent, ".") {
+		subdomain = strings.TrimSuffix(parent, ".")
+	}
+
+	return subdomain
+}
+
+// parseIntegerIpV4 decodes nip.io-style single-label IPv4 addresses, either
+// 8 hex digits ("c0a8011d") or a 32-bit decimal integer ("3232235805").
+// Decimal labels below 1.0.0.0 are ignored so that a bare number like the
+// "29" in "prefixed-192.168.1.29" is not mistaken for an address.
+func parseIntegerIpV4(label string) (net.IP, string) {
+	var value uint64
+	var err error
+	var encoding string
+	switch {
+	case len(label) == 8 && allBytes(label, isHexDigit):
+		value, err = strconv.ParseUint(label, 16, 32)
+		encoding = encodingHex
+	case len(label) >= 8 && len(label) <= 10 && label[0] != '0' && allBytes(label, isDigit):
+		value, err = strconv.ParseUint(label, 10, 32)
+		if value < 1<<24 {
+			return nil, encodingNone
+		}
+		encoding = encodingDecimal
+	default:
+		return nil, encodingNone
+	}
+	if err != nil {
+		return nil, encodingNone
+	}
+
+	return net.IP{byte(value >> 24), byte(value >> 16), byte(value >> 8), byte(value)}, encoding
+}
+
+func allBytes(s string, predicate func(byte) bool) bool {
+	for i := range len(s) {
+		if !predicate(s[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fqdnToAAAA synthesizes AAAA records from sslip.io-style dashed IPv6 labels,
+// e.g. "2001-db8--1" for "2001:db8::1". The address must fill a whole label,
+// which starts like the IPv4 ones do, see startsAddressLabel ("app.fe80--1").
+func (xip *Xip) fqdnToAAAA(fqdn string) []*dns.AAAA {
+	aaaaRecords, _ := xip.resolveAAAA(fqdn)
+	return aaaaRecords
+}
 
-			return []*dns.A{{
+// resolveAAAA returns the AAAA records of fqdn along with the encoding they
+// were found with.
+func (xip *Xip) resolveAAAA(fqdn string) ([]*dns.AAAA, string) {
+	normalizedFqdn := strings.ToLower(fqdn)
+	records := xip.records.Load().records(normalizedFqdn).AAAA
+	if records != nil {
+		var aaaaRecords []*dns.AAAA
+
+		for _, record := range records {
+			aaaaRecords = append(aaaaRecords, &dns.AAAA{
 				Hdr: dns.RR_Header{
-					Ttl:    uint32((time.Minute * 5).Seconds()),
+					Ttl:    xip.ttls.forRecord(fqdn, dns.TypeAAAA),
 					Name:   fqdn,
-					Rrtype: dns.TypeA,
+					Rrtype: dns.TypeAAAA,
 					Class:  dns.ClassINET,
 				},
-				A: ipV4Address,
-			}}
+				AAAA: record,
+			})
 		}
+
+		return aaaaRecords, encodingStatic
 	}
 
-	return nil
+	subdomain := xip.subdomain(normalizedFqdn)
+	var label string
+	for start := 0; start < len(subdomain); start += len(label) + 1 {
+		label, _, _ = strings.Cut(subdomain[start:], ".")
+		if !startsAddressLabel(subdomain, start) {
+			continue
+		}
+		ipV6Address := parseDashedIpV6(label)
+		if ipV6Address == nil {
+			continue
+		}
+
+		return []*dns.AAAA{{
+			Hdr: dns.RR_Header{
+				Ttl:    xip.ttls.forSynthesized(dns.TypeAAAA),
+				Name:   fqdn,
+				Rrtype: dns.TypeAAAA,
+				Class:  dns.ClassINET,
+			},
+			AAAA: ipV6Address,
+		}}, encodingIpV6
+	}
+
+	return nil, encodingNone
+}
+
+func parseDashedIpV6(label string) net.IP {
+	if !dashedIpV6Regex.MatchString(label) {
+		return nil
+	}
+
+	return net.ParseIP(strings.ReplaceAll(label, "-", ":"))
+}
+
+func (xip *Xip) zone() string {
+	return fmt.Sprintf("%s.", xip.domain)
+}
+
+// nameExists tells whether fqdn owns records, static or synthesized, or is
+// an empty non-terminal: a name without records of its own but with
+// descendants that have some, like "_tcp" in "_autodiscover._tcp". Names that
+// exist get NODATA answers for the types they don't have, other names get
+// NXDOMAIN.
+func (xip *Xip) nameExists(fqdn string) bool {
+	normalizedFqdn := dns.CanonicalName(fqdn)
+	if normalizedFqdn == xip.zone() {
+		return true
+	}
+
+	if _, exists := xip.records.Load().lookup(normalizedFqdn); exists {
+		return true
+	}
+
+	return len(xip.fqdnToA(fqdn)) > 0 || len(xip.fqdnToAAAA(fqdn)) > 0
+}
+
+func (xip *Xip) hasCNAME(fqdn string) bool {
+	return len(xip.records.Load().records(strings.ToLower(fqdn)).CNAME) > 0
 }
 
 func (xip *Xip) answerWithAuthority(question dns.Question, message *dns.Msg) {
-	message.Ns = append(message.Ns, xip.soaRecord(question))
+	// the SOA of negative answers is owned by the zone apex, not the queried
+	// name, and its TTL caps how long resolvers cache them (RFC 2308)
+	soa := xip.soaRecord(dns.Question{Name: xip.zone(), Qtype: dns.TypeSOA, Qclass: question.Qclass})
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	message.Ns = append(message.Ns, soa)
 }
 
 func (xip *Xip) handleA(question dns.Question, message *dns.Msg) {
 	fqdn := question.Name
-	aRecords := xip.fqdnToA(fqdn)
+	aRecords, encoding := xip.resolveA(fqdn)
+	xip.metrics.observeAddressAnswer(dns.TypeA, encoding)
 
 	if len(aRecords) == 0 {
-		message.Rcode = dns.RcodeNameError
 		xip.answerWithAuthority(question, message)
 		return
 	}
@@ -165,36 +562,33 @@ func (xip *Xip) handleA(question dns.Question, message *dns.Msg) {
 
 func (xip *Xip) handleAAAA(question dns.Question, message *dns.Msg) {
 	fqdn := question.Name
-	normalizedFqdn := strings.ToLower(fqdn)
-	xip.recordsMu.RLock()
-	records := xip.records[normalizedFqdn].AAAA
-	xip.recordsMu.RUnlock()
-	if records == nil {
+	aaaaRecords, encoding := xip.resolveAAAA(fqdn)
+	xip.metrics.observeAddressAnswer(dns.TypeAAAA, encoding)
+
+	if len(aaaaRecords) == 0 {
 		xip.answerWithAuthority(question, message)
 		return
 	}
 
-	for _, record := range records {
-		message.Answer = append(message.Answer, &dns.AAAA{
-			Hdr: dns.RR_Header{
-				Ttl:    uint32((time.Minute * 5).Seconds()),
-				Name:   fqdn,
-				Rrtype: dns.TypeAAAA,
-				Class:  dns.ClassINET,
-			},
-			AAAA: record,
-		})
+	for _, record := range aaaaRecords {
+		message.Answer = append(message.Answer, record)
 	}
 }
 
 func (xip *Xip) handleNS(question dns.Question, message *dns.Msg) {
 	fqdn := question.Name
+	if !strings.EqualFold(fqdn, xip.zone()) {
+		// there are no delegations, the zone's NS records are the only ones
+		xip.answerWithAuthority(question, message)
+		return
+	}
+
 	nameServers := []*dns.NS{}
 	additionals := []*dns.A{}
 	for _, ns := range xip.nameServers {
 		nameServers = append(nameServers, &dns.NS{
 			Hdr: dns.RR_Header{
-				Ttl:    uint32((time.Minute * 5).Seconds()),
+				Ttl:    xip.ttls.forRecord(fqdn, dns.TypeNS),
 				Name:   fqdn,
 				Rrtype: dns.TypeNS,
 				Class:  dns.ClassINET,
@@ -224,9 +618,7 @@ func chunkBy(str string, chunkSize int) (chunks []string) {
 func (xip *Xip) handleTXT(question dns.Question, message *dns.Msg) {
 	fqdn := question.Name
 	normalizedFqdn := strings.ToLower(fqdn)
-	xip.recordsMu.RLock()
-	records := xip.records[normalizedFqdn].TXT
-	xip.recordsMu.RUnlock()
+	records := xip.records.Load().records(normalizedFqdn).TXT
 	if records == nil {
 		xip.answerWithAuthority(question, message)
 		return
@@ -235,7 +627,7 @@ func (xip *Xip) handleTXT(question dns.Question, message *dns.Msg) {
 	for _, record := range records {
 		message.Answer = append(message.Answer, &dns.TXT{
 			Hdr: dns.RR_Header{
-				Ttl:    uint32((time.Minute * 5).Seconds()),
+				Ttl:    xip.ttls.forRecord(fqdn, dns.TypeTXT),
 				Name:   fqdn,
 				Rrtype: dns.TypeTXT,
 				Class:  dns.ClassINET,
@@ -248,9 +640,7 @@ func (xip *Xip) handleTXT(question dns.Question, message *dns.Msg) {
 func (xip *Xip) handleMX(question dns.Question, message *dns.Msg) {
 	fqdn := question.Name
 	normalizedFqdn := strings.ToLower(fqdn)
-	xip.recordsMu.RLock()
-	records := xip.records[normalizedFqdn].MX
-	xip.recordsMu.RUnlock()
+	records := xip.records.Load().records(normalizedFqdn).MX
 	if records == nil {
 		xip.answerWithAuthority(question, message)
 		return
@@ -259,7 +649,7 @@ func (xip *Xip) handleMX(question dns.Question, message *dns.Msg) {
 	for _, record := range records {
 		message.Answer = append(message.Answer, &dns.MX{
 			Hdr: dns.RR_Header{
-				Ttl:    uint32((time.Minute * 5).Seconds()),
+				Ttl:    xip.ttls.forRecord(fqdn, dns.TypeMX),
 				Name:   fqdn,
 				Rrtype: dns.TypeMX,
 				Class:  dns.ClassINET,
@@ -273,9 +663,7 @@ func (xip *Xip) handleMX(question dns.Question, message *dns.Msg) {
 func (xip *Xip) handleCNAME(question dns.Question, message *dns.Msg) {
 	fqdn := question.Name
 	normalizedFqdn := strings.ToLower(fqdn)
-	xip.recordsMu.RLock()
-	records := xip.records[normalizedFqdn].CNAME
-	xip.recordsMu.RUnlock()
+	records := xip.records.Load().records(normalizedFqdn).CNAME
 	if records == nil {
 		xip.answerWithAuthority(question, message)
 		return
@@ -284,7 +672,7 @@ func (xip *Xip) handleCNAME(question dns.Question, message *dns.Msg) {
 	for _, record := range records {
 		message.Answer = append(message.Answer, &dns.CNAME{
 			Hdr: dns.RR_Header{
-				Ttl:    uint32((time.Minute * 5).Seconds()),
+				Ttl:    xip.ttls.forRecord(fqdn, dns.TypeCNAME),
 				Name:   fqdn,
 				Rrtype: dns.TypeCNAME,
 				Class:  dns.ClassINET,
@@ -297,29 +685,58 @@ func (xip *Xip) handleCNAME(question dns.Question, message *dns.Msg) {
 func (xip *Xip) handleSRV(question dns.Question, message *dns.Msg) {
 	fqdn := question.Name
 	normalizedFqdn := strings.ToLower(fqdn)
-	xip.recordsMu.RLock()
-	record := xip.records[normalizedFqdn].SRV
-	xip.recordsMu.RUnlock()
-	if record == nil {
+	records := xip.records.Load().records(normalizedFqdn).SRV
+	if records == nil {
 		xip.answerWithAuthority(question, message)
 		return
 	}
 
-	message.Answer = append(message.Answer, &dns.SRV{
-		Hdr: dns.RR_Header{
-			Ttl:    uint32((time.Minute * 5).Seconds()),
-			Name:   fqdn,
-			Rrtype: dns.TypeSRV,
-			Class:  dns.ClassINET,
-		},
-		Priority: record.Priority,
-		Weight:   record.Weight,
-		Port:     record.Port,
-		Target:   record.Target,
-	})
+	for _, record := range records {
+		message.Answer = append(message.Answer, &dns.SRV{
+			Hdr: dns.RR_Header{
+				Ttl:    xip.ttls.forRecord(fqdn, dns.TypeSRV),
+				Name:   fqdn,
+				Rrtype: dns.TypeSRV,
+				Class:  dns.ClassINET,
+			},
+			Priority: record.Priority,
+			Weight:   record.Weight,
+			Port:     record.Port,
+			Target:   record.Target,
+		})
+	}
+}
+
+func (xip *Xip) handleCAA(question dns.Question, message *dns.Msg) {
+	fqdn := question.Name
+	normalizedFqdn := strings.ToLower(fqdn)
+	records := xip.records.Load().records(normalizedFqdn).CAA
+	if records == nil {
+		xip.answerWithAuthority(question, message)
+		return
+	}
+
+	for _, record := range records {
+		message.Answer = append(message.Answer, &dns.CAA{
+			Hdr: dns.RR_Header{
+				Ttl:    xip.ttls.forRecord(fqdn, dns.TypeCAA),
+				Name:   fqdn,
+				Rrtype: dns.TypeCAA,
+				Class:  dns.ClassINET,
+			},
+			Flag:  record.Flag,
+			Tag:   record.Tag,
+			Value: record.Value,
+		})
+	}
 }
 
 func (xip *Xip) handleSOA(question dns.Question, message *dns.Msg) {
+	if !strings.EqualFold(question.Name, xip.zone()) {
+		xip.answerWithAuthority(question, message)
+		return
+	}
+
 	message.Answer = append(message.Answer, xip.soaRecord(question))
 }
 
@@ -336,21 +753,21 @@ func (xip *Xip) soaRecord(question dns.Question) *dns.SOA {
 		Name:     question.Name,
 		Rrtype:   dns.TypeSOA,
 		Class:    dns.ClassINET,
-		Ttl:      uint32((time.Minute * 5).Seconds()),
+		Ttl:      xip.ttls.forRecord(question.Name, dns.TypeSOA),
 		Rdlength: 0,
 	}
 	soa.Ns = xip.nameServers[0]
 	soa.Mbox = emailToRname(xip.email)
-	soa.Serial = 2024072600
-	soa.Refresh = uint32((time.Minute * 15).Seconds())
-	soa.Retry = uint32((time.Minute * 15).Seconds())
-	soa.Expire = uint32((time.Minute * 30).Seconds())
-	soa.Minttl = uint32((time.Minute * 5).Seconds())
+	soa.Serial = xip.serial.Load()
+	soa.Refresh = seconds(xip.ttls.SOARefresh)
+	soa.Retry = seconds(xip.ttls.SOARetry)
+	soa.Expire = seconds(xip.ttls.SOAExpire)
+	soa.Minttl = seconds(xip.ttls.SOAMinimum)
 
 	return soa
 }
 
-func (xip *Xip) handleQuery(message *dns.Msg) {
+func (xip *Xip) handleQuery(message *dns.Msg, network string) {
 	if len(message.Question) != 1 {
 		// see https://serverfault.com/a/742788
 		utils.Logger.Error().Any("questions", message.Question).Msg("Received an incorrect amount of questions")
@@ -359,6 +776,38 @@ func (xip *Xip) handleQuery(message *dns.Msg) {
 	}
 
 	question := message.Question[0]
+	if question.Qclass == dns.ClassCHAOS {
+		xip.handleChaos(question, message)
+		return
+	}
+
+	if !dns.IsSubDomain(xip.zone(), question.Name) {
+		// we're not a resolver, and have no authority over other zones
+		message.Rcode = dns.RcodeRefused
+		return
+	}
+
+	if !xip.nameExists(question.Name) {
+		message.Rcode = dns.RcodeNameError
+		xip.answerWithAuthority(question, message)
+		return
+	}
+
+	if question.Qtype != dns.TypeCNAME && xip.hasCNAME(question.Name) {
+		// a CNAME is the only record of its name, whatever the type queried
+		xip.handleCNAME(question, message)
+		return
+	}
+
+	if question.Qtype == dns.TypeANY {
+		xip.handleANY(question, message, network)
+		return
+	}
+
+	xip.handleType(question, message)
+}
+
+func (xip *Xip) handleType(question dns.Question, message *dns.Msg) {
 	switch question.Qtype {
 	case dns.TypeA:
 		xip.handleA(question, message)
@@ -374,30 +823,130 @@ func (xip *Xip) handleQuery(message *dns.Msg) {
 		xip.handleCNAME(question, message)
 	case dns.TypeSRV:
 		xip.handleSRV(question, message)
+	case dns.TypeCAA:
+		xip.handleCAA(question, message)
 	case dns.TypeSOA:
 		xip.handleSOA(question, message)
+	case dns.TypeDNSKEY:
+		xip.handleDNSKEY(question, message)
 	default:
-		xip.handleSOA(question, message)
+		xip.answerWithAuthority(question, message)
 	}
 }
 
+// handleANY answers ANY queries with a synthesized HINFO record as
+// recommended by RFC 8482, so that they can't be used for amplification.
+// Clients querying over TCP can be given every record of the name instead.
+func (xip *Xip) handleANY(question dns.Question, message *dns.Msg, network string) {
+	if xip.anyResponse == AnyResponseTCP && network == "tcp" {
+		for _, rrtype := range xip.typesAt(question.Name) {
+			if rrtype == dns.TypeRRSIG || rrtype == dns.TypeNSEC {
+				continue
+			}
+
+			scratch := new(dns.Msg)
+			xip.handleType(dns.Question{Name: question.Name, Qtype: rrtype, Qclass: question.Qclass}, scratch)
+			message.Answer = append(message.Answer, scratch.Answer...)
+		}
+		return
+	}
+
+	message.Answer = append(message.Answer, &dns.HINFO{
+		Hdr: dns.RR_Header{
+			Ttl:    xip.ttls.forRecord(question.Name, dns.TypeHINFO),
+			Name:   question.Name,
+			Rrtype: dns.TypeHINFO,
+			Class:  dns.ClassINET,
+		},
+		Cpu: "RFC8482",
+		Os:  "",
+	})
+}
+
+// respond builds the response to request as received over network, either
+// "udp" or "tcp".
+func (xip *Xip) respond(request *dns.Msg, network string) *dns.Msg {
+	message := new(dns.Msg)
+	message.SetReply(request)
+	message.Compress = true
+	message.Authoritative = true
+	message.RecursionAvailable = false
+
+	if !xip.checkEdns(request, message) {
+		return message
+	}
+
+	switch request.Opcode {
+	case dns.OpcodeQuery:
+		xip.handleQuery(message, network)
+	default:
+		message.MsgHdr.Rcode = dns.RcodeRefused
+	}
+
+	xip.signResponse(request, message)
+	xip.finishEdns(request, message, network)
+	return message
+}
+
 func (xip *Xip) handleDnsRequest(response dns.ResponseWriter, request *dns.Msg) {
-	go func() {
-		message := new(dns.Msg)
-		message.SetReply(request)
-		message.Compress = true
-		message.Authoritative = true
-		message.RecursionAvailable = false
-
-		switch request.Opcode {
-		case dns.OpcodeQuery:
-			xip.handleQuery(message)
-		default:
-			message.MsgHdr.Rcode = dns.RcodeRefused
+	if isTransfer(request) {
+		// transfers own the connection until they're done
+		xip.handleTransfer(response, request)
+		return
+	}
+
+	// like a lost packet, clients will retry, hopefully when we're less busy
+	xip.servePooled(response, request)
+}
+
+// servePooled serves request once a worker of the pool is free, and tells
+// whether one was before the query deadline. Queries that didn't get one
+// are counted as dropped and left unanswered.
+func (xip *Xip) servePooled(response dns.ResponseWriter, request *dns.Msg) bool {
+	if !xip.pool.acquire(time.Now().Add(xip.queryTimeout)) {
+		xip.metrics.observeDrop(dropOverloaded)
+		return false
+	}
+	defer xip.pool.release()
+
+	xip.serveDNS(response, request)
+	return true
+}
+
+// serveDNS answers request and writes the response, unless rate limiting
+// drops it.
+func (xip *Xip) serveDNS(response dns.ResponseWriter, request *dns.Msg) {
+	xip.inflight.add()
+	defer xip.inflight.done()
+
+	start := time.Now()
+	if xip.dnstap != nil {
+		xip.dnstap.logQuery(response, request, start)
+	}
+	transport := transport(response)
+	// only plain UDP limits the size of responses and lets clients spoof
+	// their address, every other transport is connection-oriented
+	network := "tcp"
+	if transport == "udp" {
+		network = "udp"
+	}
+	message := xip.respond(request, network)
+	defer xip.metrics.observeRequest(request, message, transport, start)
+	if network == "udp" && xip.rateLimiter != nil {
+		switch xip.rateLimiter.check(response.RemoteAddr(), message) {
+		case rateLimitDrop:
+			utils.Logger.Debug().Str("remote_address", response.RemoteAddr().String()).Msg("Dropped rate limited response")
+			return
+		case rateLimitSlip:
+			slipResponse(message)
 		}
+	}
 
-		question := anyWhitespaceRegex.ReplaceAllString(request.Question[0].String(), " ")
-		logEvent := utils.Logger.Debug().Str("question", question)
+	// formatting records is costly, skip it when debug logs are disabled
+	if logEvent := utils.Logger.Debug(); logEvent.Enabled() {
+		if len(request.Question) > 0 {
+			logEvent.Str("question", anyWhitespaceRegex.ReplaceAllString(request.Question[0].String(), " "))
+		}
 		if flyRegion != "" {
 			logEvent.Str("FLY_REGION", flyRegion)
 		}
@@ -407,40 +956,209 @@ func (xip *Xip) handleDnsRequest(response dns.ResponseWriter, request *dns.Msg)
 			logEvent.Str(key, value)
 		}
 		logEvent.Msg("resolved")
+	}
 
-		error := response.WriteMsg(message)
-		if error != nil {
-			utils.Logger.Debug().Msg(message.String())
-			utils.Logger.Error().Err(error).Str("message", message.String()).Msg("Error responding to query")
+	error := writeMsg(response, request, message)
+	if error != nil {
+		utils.Logger.Debug().Msg(message.String())
+		utils.Logger.Error().Err(error).Str("message", message.String()).Msg("Error responding to query")
+	}
+	if xip.dnstap != nil {
+		xip.dnstap.logResponse(response, request, message, start)
+	}
+}
+
+// dnsServer is a listener run by listenAndServe, either a *dns.Server or a
+// *doqServer.
+type dnsServer interface {
+	ListenAndServe() error
+	ShutdownContext(ctx context.Context) error
+}
+
+// newServers returns the UDP servers listening on each of udpAddresses and
+// the TCP ones listening on each of tcpAddresses, one per socket, along with
+// the DNS over QUIC and DNS over TLS ones on the same hosts when enabled.
+// The *dns.Server ones route queries through xip.mux.
+func (xip *Xip) newServers(udpAddresses []string, tcpAddresses []string) []dnsServer {
+	reusePort := xip.dnsSockets > 1
+	var servers []dnsServer
+	for _, addr := range udpAddresses {
+		for range xip.dnsSockets {
+			servers = append(servers, &dns.Server{Addr: addr, Net: "udp", Handler: xip.mux, TsigProvider: xip.tsigProvider(), ReusePort: reusePort})
 		}
-	}()
+
+		if xip.doqPort != 0 {
+			host, _, _ := net.SplitHostPort(addr)
+			servers = append(servers, &doqServer{
+				xip:  xip,
+				addr: net.JoinHostPort(host, strconv.FormatUint(uint64(xip.doqPort), 10)),
+			})
+		}
+	}
+	for _, addr := range tcpAddresses {
+		for range xip.dnsSockets {
+			servers = append(servers, &dns.Server{Addr: addr, Net: "tcp", Handler: xip.mux, TsigProvider: xip.tsigProvider(), ReusePort: reusePort})
+		}
+
+		if xip.dotPort != 0 {
+			host, _, _ := net.SplitHostPort(addr)
+			servers = append(servers, &dns.Server{
+				Addr:         net.JoinHostPort(host, strconv.FormatUint(uint64(xip.dotPort), 10)),
+				Net:          "tcp-tls",
+				Handler:      xip.mux,
+				TLSConfig:    xip.tlsConfig(),
+				TsigProvider: xip.tsigProvider(),
+			})
+		}
+	}
+
+	return servers
 }
 
-func (xip *Xip) StartServer() {
-	if _, exists := os.LookupEnv("FLY_APP_NAME"); exists {
-		// we're probably running on fly, bind to fly-global-services
-		xip.server.Addr = "fly-global-services" + xip.server.Addr
+// listenAddresses returns the addresses the DNS servers listen on, by
+// default every interface on the DNS port.
+func (xip *Xip) listenAddresses() []string {
+	if len(xip.dnsListen) > 0 {
+		return xip.dnsListen
 	}
 
-	err := xip.server.ListenAndServe()
-	defer xip.server.Shutdown()
-	if err != nil {
-		utils.Logger.Error().Err(err).Msg("Failed to start DNS server")
-		if strings.Contains(err.Error(), "fly-global-services: no such host") {
-			// we're not running on fly, bind to 0.0.0.0 instead
-			port := strings.Split(xip.server.Addr, ":")[1]
-			xip.server = dns.Server{
-				Addr: fmt.Sprintf(":%s", port),
-				Net:  "udp",
-			}
+	return []string{net.JoinHostPort("", strconv.FormatUint(uint64(xip.dnsPort), 10))}
+}
 
-			xip.StartServer()
-			return
+// tcpListenAddresses returns the addresses the TCP servers listen on, by
+// default the same as the UDP ones.
+func (xip *Xip) tcpListenAddresses() []string {
+	if len(xip.dnsTcpListen) > 0 {
+		return xip.dnsTcpListen
+	}
+
+	return xip.listenAddresses()
+}
+
+func (xip *Xip) shutdownServers(ctx context.Context) {
+	for _, server := range xip.servers {
+		// servers that failed to start return an error we don't care about
+		server.ShutdownContext(ctx)
+	}
+}
+
+// StartServer serves DNS until ctx is done, then stops accepting queries
+// and waits for the ones in flight to be answered. It only returns early if
+// a server fails.
+func (xip *Xip) StartServer(ctx context.Context) error {
+	if err := xip.listenAndServe(ctx); err != nil {
+		return err
+	}
+
+	xip.drain()
+	return nil
+}
+
+// listenAndServe runs every server until ctx is done or one of them stops,
+// then shuts them all down and returns the error that stopped the first one.
+func (xip *Xip) listenAndServe(ctx context.Context) error {
+	errs := make(chan error, len(xip.servers))
+	for _, server := range xip.servers {
+		switch server := server.(type) {
+		case *dns.Server:
+			utils.Logger.Info().Str("dns_address", server.Addr).Str("net", server.Net).Bool("reuse_port", server.ReusePort).Msg("Starting up DNS server")
+		case *doqServer:
+			utils.Logger.Info().Str("dns_address", server.addr).Str("net", "quic").Msg("Starting up DNS server")
 		}
+		go func() {
+			errs <- server.ListenAndServe()
+		}()
+	}
 
-		utils.Logger.Fatal().Err(err).Msg("Failed to start DNS server")
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		utils.Logger.Info().Msg("Shutting down DNS server")
 	}
-	utils.Logger.Info().Str("dns_address", xip.server.Addr).Msg("Starting up DNS server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	xip.shutdownServers(shutdownCtx)
+	return err
+}
+
+// inflightQueries counts the queries being answered over every transport.
+// Unlike a sync.WaitGroup, queries can keep coming while it is waited for,
+// DNS over HTTPS ones being served until the HTTP servers shut down.
+type inflightQueries struct {
+	mu    sync.Mutex
+	count int
+	idle  chan struct{}
+}
+
+func (q *inflightQueries) add() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.count++
+}
+
+func (q *inflightQueries) done() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.count--
+	if q.count == 0 && q.idle != nil {
+		close(q.idle)
+		q.idle = nil
+	}
+}
+
+// wait returns a channel closed once no query is in flight.
+func (q *inflightQueries) wait() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	idle := make(chan struct{})
+	if q.count == 0 {
+		close(idle)
+	} else {
+		q.idle = idle
+	}
+
+	return idle
+}
+
+// drain waits for the queries in flight to be answered, up to
+// ShutdownTimeout, then flushes the dnstap output.
+func (xip *Xip) drain() {
+	select {
+	case <-xip.inflight.wait():
+		utils.Logger.Info().Msg("DNS server shut down correctly")
+	case <-time.After(ShutdownTimeout):
+		utils.Logger.Warn().Msg("Timed out waiting for DNS queries in flight")
+	}
+
+	if xip.dnstap != nil {
+		xip.dnstap.close()
+	}
+}
+
+// readStaticRecords reads the records of the zone file, or returns the
+// built-in ones when there is none.
+func (xip *Xip) readStaticRecords() (map[string]hardcodedRecord, error) {
+	if xip.zoneFile == "" {
+		return initialRecords(), nil
+	}
+
+	return parseZoneFile(xip.zoneFile, xip.zone())
+}
+
+// rebuildRecords merges the static and dynamic records into a new snapshot
+// of the served ones. Callers must hold recordsMu.
+func (xip *Xip) rebuildRecords() {
+	records := map[string]hardcodedRecord{}
+	mergeRecords(records, xip.staticRecords)
+	mergeRecords(records, xip.dynamicRecords)
+	xip.records.Store(newRecordSet(xip.zone(), records))
+
+	// unix timestamps make good serials as long as changes are less
+	// frequent than once per second on average
+	xip.serial.Store(max(xip.serial.Load()+1, uint32(time.Now().Unix())))
+	xip.notifySecondaries()
 }
 
 func (xip *Xip) initNameServers(nameServers []string) {
@@ -454,42 +1172,130 @@ func (xip *Xip) initNameServers(nameServers []string) {
 		ip := net.ParseIP(ns)
 
 		rootDomainARecords = append(rootDomainARecords, ip)
-		entry := xip.records[name]
-		entry.A = append(xip.records[name].A, ip)
-		xip.records[name] = entry
+		entry := xip.dynamicRecords[name]
+		entry.A = append(xip.dynamicRecords[name].A, ip)
+		xip.dynamicRecords[name] = entry
 
 		xip.nameServers = append(xip.nameServers, name)
 	}
 
-	xip.records[fmt.Sprintf("%s.", xip.domain)] = hardcodedRecord{A: rootDomainARecords}
+	xip.dynamicRecords[xip.zone()] = hardcodedRecord{A: rootDomainARecords}
 
-	xip.records[fmt.Sprintf("_acme-challenge.%s.", xip.domain)] = hardcodedRecord{TXT: []string{}}
+	xip.dynamicRecords[fmt.Sprintf("_acme-challenge.%s.", xip.domain)] = hardcodedRecord{TXT: []string{}}
 }
 
 func NewXip(opts ...Option) (xip *Xip) {
 	config := utils.GetConfig()
 	xip = &Xip{
-		domain:  config.Domain,
-		email:   config.Email,
-		dnsPort: config.DnsPort,
-		records: initialRecords(),
+		domain:         config.Domain,
+		email:          config.Email,
+		dnsPort:        config.DnsPort,
+		dnsListen:      config.DnsListen,
+		dnsTcpListen:   config.DnsTcpListen,
+		ednsUdpSize:    config.EdnsUdpSize,
+		zoneFile:       config.ZoneFile,
+		secondaries:    config.Secondaries,
+		ttls:           ttlsFromConfig(),
+		anyResponse:    config.AnyResponse,
+		nsid:           nsidFromConfig(),
+		dynamicRecords: map[string]hardcodedRecord{},
+	}
+	WithChaosRecords(chaosRecordsFromConfig())(xip)
+	if config.CAA {
+		xip.caaIssuer = config.CAAIssuer
+		if xip.caaIssuer == "" {
+			xip.caaIssuer = caaIssuerFromDirectory(config.CADirURL)
+		}
+		xip.caaPinAccount = config.CAAAccountURI
+	}
+	if config.TsigKey != "" {
+		WithTsigKey(config.TsigKey)(xip)
+	}
+	if config.Dnssec {
+		xip.dnssecKeysDir = config.DnssecKeysDir
 	}
+	WithRateLimit(rateLimitFromConfig())(xip)
+	if config.Dot {
+		xip.dotPort = config.DotPort
+	}
+	if config.Doq {
+		xip.doqPort = config.DoqPort
+		xip.doqMaxStreams = config.DoqMaxStreams
+	}
+	if config.Dnstap != "" {
+		WithDnstap(config.Dnstap)(xip)
+	}
+	xip.dnsSockets = config.DnsSockets
+	xip.workers = config.Workers
+	xip.queryTimeout = config.QueryTimeout
 
 	for _, opt := range opts {
 		opt(xip)
 	}
 
+	xip.ttls = xip.ttls.withDefaults()
+
+	if xip.ednsUdpSize == 0 {
+		xip.ednsUdpSize = defaultEdnsUdpSize
+	}
+
 	if len(xip.nameServers) == 0 {
 		xip.initNameServers(config.NameServers)
 	}
 
-	xip.server = dns.Server{
-		Addr: fmt.Sprintf(":%d", xip.dnsPort),
-		Net:  "udp",
+	if caaRecords := xip.caaRecords(); caaRecords != nil {
+		rootRecords := xip.dynamicRecords[xip.zone()]
+		rootRecords.CAA = caaRecords
+		xip.dynamicRecords[xip.zone()] = rootRecords
+	}
+
+	staticRecords, err := xip.readStaticRecords()
+	if err != nil {
+		utils.Logger.Fatal().Err(err).Str("zone_file", xip.zoneFile).Msg("Failed to load static records")
+	}
+	xip.recordsMu.Lock()
+	if err := xip.checkStaticRecords(staticRecords); err != nil {
+		utils.Logger.Fatal().Err(err).Str("zone_file", xip.zoneFile).Msg("Failed to load static records")
+	}
+	xip.staticRecords = staticRecords
+	xip.rebuildRecords()
+	xip.recordsMu.Unlock()
+
+	if xip.dnssecKeysDir != "" && len(xip.secondaries) > 0 {
+		// secondaries would serve the records unsigned, while the DS record
+		// published by the parent zone tells resolvers to expect signatures
+		utils.Logger.Fatal().Msg("Zone transfers to secondaries aren't supported with DNSSEC")
 	}
+	if xip.dnssecKeysDir != "" {
+		if err := xip.loadDnssecKeys(); err != nil {
+			utils.Logger.Fatal().Err(err).Msg("Failed to load DNSSEC keys")
+		}
+	}
+
+	xip.metrics = newMetrics(xip)
 
-	zone := fmt.Sprintf("%s.", xip.domain)
-	dns.HandleFunc(zone, xip.handleDnsRequest)
+	if (xip.dotPort != 0 || xip.doqPort != 0) && (xip.rootCertificate == nil || xip.wildcardCertificate == nil) {
+		utils.Logger.Fatal().Msg("DNS over TLS and DNS over QUIC require TLS certificates")
+	}
+	if xip.doqMaxStreams == 0 {
+		xip.doqMaxStreams = defaultDoqMaxStreams
+	}
+	if xip.dnsSockets <= 0 {
+		xip.dnsSockets = runtime.GOMAXPROCS(0)
+	}
+	if xip.workers <= 0 {
+		xip.workers = defaultWorkers()
+	}
+	if xip.queryTimeout <= 0 {
+		xip.queryTimeout = defaultQueryTimeout
+	}
+	xip.pool = newWorkerPool(xip.workers)
+	xip.mux = dns.NewServeMux()
+	xip.mux.HandleFunc(xip.zone(), xip.handleDnsRequest)
+	// queries for other zones go through the same path to be refused by
+	// handleQuery, rate limited, measured and logged like any other
+	xip.mux.HandleFunc(".", xip.handleDnsRequest)
+	xip.servers = xip.newServers(xip.listenAddresses(), xip.tcpListenAddresses())
 
 	return xip
 }
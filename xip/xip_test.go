@@ -1,10 +1,38 @@
 package xip
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestResolveDashUnit(t *testing.T) {
@@ -39,6 +67,92 @@ func TestResolveDashUnit(t *testing.T) {
 	if A != nil {
 		t.Fatalf("Expected %v but received %s", nil, A)
 	}
+
+	A = xip.fqdnToA("app-.192-168-1-29.local-ip.sh")
+	if A != nil {
+		t.Fatalf("Expected %v but received %s", nil, A)
+	}
+}
+
+func TestResolveIntegerUnit(t *testing.T) {
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithDnsPort(9053),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+	)
+
+	for fqdn, expected := range map[string]string{
+		"c0a8011d.local-ip.sh":            "192.168.1.29",
+		"C0A8011D.local-ip.sh.":           "192.168.1.29",
+		"app.c0a8011d.local-ip.sh":        "192.168.1.29",
+		"7f000001.local-ip.sh":            "127.0.0.1",
+		"3232235805.local-ip.sh":          "192.168.1.29",
+		"prefixed.2130706433.local-ip.sh": "127.0.0.1",
+	} {
+		A := xip.fqdnToA(fqdn)
+		if len(A) != 1 {
+			t.Fatalf("Expected one record for %s but received %v", fqdn, A)
+		}
+		received := A[0].A.String()
+		if received != expected {
+			t.Fatalf("Expected %s but received %s", expected, received)
+		}
+	}
+
+	for _, fqdn := range []string{
+		"c0a8011.local-ip.sh",
+		"c0a8011d0.local-ip.sh",
+		"prefixed-c0a8011d.local-ip.sh",
+		"4294967296.local-ip.sh",
+		"0323223580.local-ip.sh",
+		"29.local-ip.sh",
+	} {
+		if A := xip.fqdnToA(fqdn); A != nil {
+			t.Fatalf("Expected %v for %s but received %s", nil, fqdn, A)
+		}
+	}
+}
+
+func TestResolveIpV6Unit(t *testing.T) {
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithDnsPort(9053),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+	)
+
+	for fqdn, expected := range map[string]string{
+		"fe80--1.local-ip.sh":                     "fe80::1",
+		"2001-db8--42.local-ip.sh.":               "2001:db8::42",
+		"app.2001-db8--1.local-ip.sh":             "2001:db8::1",
+		"--1.local-ip.sh":                         "::1",
+		"2001-0db8-0-0-0-0-0-1.local-ip.sh":       "2001:db8::1",
+		"foo.bar.2001-DB8-85A3--8A2E.local-ip.sh": "2001:db8:85a3::8a2e",
+		"my-app.fe80--1.local-ip.sh":              "fe80::1",
+		"_srv.fe80--1.app.local-ip.sh":            "fe80::1",
+	} {
+		AAAA := xip.fqdnToAAAA(fqdn)
+		if len(AAAA) != 1 {
+			t.Fatalf("Expected one record for %s but received %v", fqdn, AAAA)
+		}
+		received := AAAA[0].AAAA.String()
+		if received != expected {
+			t.Fatalf("Expected %s but received %s", expected, received)
+		}
+	}
+
+	for _, fqdn := range []string{
+		"local-ip.sh",
+		"192-168-1-29.local-ip.sh",
+		"prefixed-fe80--1.local-ip.sh",
+		"fe80--1-suffix.local-ip.sh",
+		"fe80--1--2.local-ip.sh",
+		"fe80--1%eth0.local-ip.sh",
+		"app-.fe80--1.local-ip.sh",
+	} {
+		if AAAA := xip.fqdnToAAAA(fqdn); AAAA != nil {
+			t.Fatalf("Expected %v for %s but received %s", nil, fqdn, AAAA)
+		}
+	}
 }
 
 func TestConstructor(t *testing.T) {
@@ -56,13 +170,774 @@ func TestConstructor(t *testing.T) {
 	}
 }
 
+func TestEdnsUnit(t *testing.T) {
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithDnsPort(9053),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+	)
+	xip.dynamicRecords["big.local-ip.sh."] = hardcodedRecord{TXT: []string{
+		strings.Repeat("a", 400),
+		strings.Repeat("b", 400),
+	}}
+	xip.rebuildRecords()
+
+	request := new(dns.Msg).SetQuestion("big.local-ip.sh.", dns.TypeTXT)
+	response := xip.respond(request, "udp")
+	if !response.Truncated || response.IsEdns0() != nil {
+		t.Fatalf("Expected a truncated response without EDNS0, received %s", response)
+	}
+
+	response = xip.respond(request, "tcp")
+	if response.Truncated || len(response.Answer) != 2 {
+		t.Fatalf("Expected a complete response over TCP, received %s", response)
+	}
+
+	request.SetEdns0(4096, false)
+	response = xip.respond(request, "udp")
+	opt := response.IsEdns0()
+	if response.Truncated || len(response.Answer) != 2 || opt == nil || opt.UDPSize() != defaultEdnsUdpSize {
+		t.Fatalf("Expected a complete response with EDNS0, received %s", response)
+	}
+
+	request.IsEdns0().SetVersion(1)
+	response = xip.respond(request, "udp")
+	if response.Rcode != dns.RcodeBadVers || len(response.Answer) != 0 || response.IsEdns0() == nil {
+		t.Fatalf("Expected BADVERS, received %s", response)
+	}
+	if _, err := response.Pack(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChaosUnit(t *testing.T) {
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithDnsPort(9053),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+		WithChaosRecords(map[string]string{ChaosVersionBind: "local-ip.sh", ChaosIdServer: "ams/host"}),
+		WithNsid("ams/host"),
+	)
+
+	request := new(dns.Msg).SetQuestion("VERSION.bind.", dns.TypeTXT)
+	request.Question[0].Qclass = dns.ClassCHAOS
+	response := xip.respond(request, "udp")
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 1 {
+		t.Fatalf("Expected a CHAOS TXT answer, received %s", response)
+	}
+	if txt, ok := response.Answer[0].(*dns.TXT); !ok || txt.Hdr.Class != dns.ClassCHAOS || txt.Txt[0] != "local-ip.sh" {
+		t.Fatalf("Expected the version in class CHAOS, received %s", response.Answer[0])
+	}
+
+	request.SetQuestion(ChaosHostnameBind, dns.TypeTXT)
+	request.Question[0].Qclass = dns.ClassCHAOS
+	response = xip.respond(request, "udp")
+	if response.Rcode != dns.RcodeRefused || len(response.Answer) != 0 {
+		t.Fatalf("Expected a disabled CHAOS name to be refused, received %s", response)
+	}
+
+	request.SetQuestion(ChaosIdServer, dns.TypeTXT)
+	request.Question[0].Qclass = dns.ClassCHAOS
+	request.SetEdns0(4096, false)
+	request.IsEdns0().Option = append(request.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	response = xip.respond(request, "udp")
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 1 {
+		t.Fatalf("Expected a CHAOS TXT answer, received %s", response)
+	}
+	opt := response.IsEdns0()
+	if opt == nil || len(opt.Option) != 1 {
+		t.Fatalf("Expected an NSID option, received %s", response)
+	}
+	if nsid, ok := opt.Option[0].(*dns.EDNS0_NSID); !ok || nsid.Nsid != hex.EncodeToString([]byte("ams/host")) {
+		t.Fatalf("Expected the NSID of the instance, received %s", opt.Option[0])
+	}
+
+	request = new(dns.Msg).SetQuestion("local-ip.sh.", dns.TypeNS)
+	request.SetEdns0(4096, false)
+	response = xip.respond(request, "udp")
+	if opt := response.IsEdns0(); opt == nil || len(opt.Option) != 0 {
+		t.Fatalf("Expected no NSID option when not asked for, received %s", response)
+	}
+
+	// without configuration, versions don't tell the instance apart
+	records := chaosRecordsFromConfig()
+	if records[ChaosVersionBind] != buildVersion() || records[ChaosVersionServer] != buildVersion() || records[ChaosIdServer] != instanceIdentifier() {
+		t.Fatalf("Unexpected default CHAOS records %v", records)
+	}
+}
+
+func TestDnssecUnit(t *testing.T) {
+	keysDir := t.TempDir()
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithEmail("admin@local-ip.sh"),
+		WithDnsPort(9053),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+		WithDnssecKeysDir(keysDir),
+	)
+
+	request := new(dns.Msg).SetQuestion("local-ip.sh.", dns.TypeDNSKEY)
+	request.SetEdns0(4096, true)
+	response := xip.respond(request, "udp")
+	if len(response.Answer) != 3 {
+		t.Fatalf("Expected 2 DNSKEY and 1 RRSIG, received %s", response)
+	}
+	rrsig := response.Answer[2].(*dns.RRSIG)
+	if err := rrsig.Verify(xip.ksk.dnskey, response.Answer[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	request = new(dns.Msg).SetQuestion("192-168-1-29.local-ip.sh.", dns.TypeA)
+	request.SetEdns0(4096, true)
+	response = xip.respond(request, "udp")
+	if len(response.Answer) != 2 {
+		t.Fatalf("Expected A and RRSIG, received %s", response)
+	}
+	rrsig = response.Answer[1].(*dns.RRSIG)
+	if err := rrsig.Verify(xip.zsk.dnskey, response.Answer[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	request = new(dns.Msg).SetQuestion("nothing.local-ip.sh.", dns.TypeA)
+	request.SetEdns0(4096, true)
+	response = xip.respond(request, "udp")
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 0 {
+		t.Fatalf("Expected a NODATA black lie, received %s", response)
+	}
+	var nsec *dns.NSEC
+	for _, record := range response.Ns {
+		if record, ok := record.(*dns.NSEC); ok {
+			nsec = record
+		}
+	}
+	if nsec == nil || nsec.Hdr.Name != "nothing.local-ip.sh." || !slices.Contains(nsec.TypeBitMap, dns.TypeNXNAME) {
+		t.Fatalf("Expected an NSEC record for nothing.local-ip.sh., received %s", response)
+	}
+
+	request.SetEdns0(4096, false)
+	response = xip.respond(request, "udp")
+	if response.Rcode != dns.RcodeNameError {
+		t.Fatalf("Expected NXDOMAIN without the DO bit, received %s", response)
+	}
+
+	reloaded := NewXip(
+		WithDomain("local-ip.sh"),
+		WithNameServers([]string{"1.2.3.4"}),
+		WithDnssecKeysDir(keysDir),
+	)
+	if reloaded.ksk.dnskey.KeyTag() != xip.ksk.dnskey.KeyTag() || reloaded.zsk.dnskey.KeyTag() != xip.zsk.dnskey.KeyTag() {
+		t.Fatal("Expected keys to be loaded from the keys directory")
+	}
+}
+
+func TestZoneFileUnit(t *testing.T) {
+	zoneFile := filepath.Join(t.TempDir(), "zone")
+	err := os.WriteFile(zoneFile, []byte(`$TTL 3600
+@                IN MX    10 mail.example.com.
+                 IN TXT   "v=spf1 include:example.com ~all ; not a comment"
+www              IN A     10.0.0.1
+www              IN AAAA  2001:db8::1
+blog             IN CNAME www
+@                IN CAA   0 issue "letsencrypt.org"
+_imaps._tcp      IN SRV   ( 0 1 993 ; multi-line record
+                            mail.example.com. )
+$ORIGIN sub
+host             IN A     10.0.0.2
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := parseZoneFile(zoneFile, "local-ip.sh.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records["local-ip.sh."].MX) != 1 || records["local-ip.sh."].TXT[0] != "v=spf1 include:example.com ~all ; not a comment" {
+		t.Errorf("Unexpected apex records %+v", records["local-ip.sh."])
+	}
+	if records["www.local-ip.sh."].A[0].String() != "10.0.0.1" || records["www.local-ip.sh."].AAAA[0].String() != "2001:db8::1" {
+		t.Errorf("Unexpected www records %+v", records["www.local-ip.sh."])
+	}
+	if records["blog.local-ip.sh."].CNAME[0] != "www.local-ip.sh." {
+		t.Errorf("Unexpected blog records %+v", records["blog.local-ip.sh."])
+	}
+	if records["_imaps._tcp.local-ip.sh."].SRV[0].Port != 993 || records["local-ip.sh."].CAA[0].Value != "letsencrypt.org" {
+		t.Errorf("Unexpected SRV or CAA records")
+	}
+	if records["host.sub.local-ip.sh."].A[0].String() != "10.0.0.2" {
+		t.Errorf("Unexpected host.sub records %+v", records["host.sub.local-ip.sh."])
+	}
+
+	err = os.WriteFile(zoneFile, []byte(`www IN A 10.0.0.1
+outside.example.com. IN A 10.0.0.2
+
+www IN NS ns.example.com.
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parseZoneFile(zoneFile, "local-ip.sh.")
+	if err == nil || !strings.Contains(err.Error(), zoneFile+":2: ") || !strings.Contains(err.Error(), zoneFile+":4: unsupported record type NS") {
+		t.Fatalf("Expected errors on lines 2 and 4, received %v", err)
+	}
+
+	// a standard zone file, with the SOA and NS records the server answers
+	// with its own
+	err = os.WriteFile(zoneFile, []byte(`$ORIGIN local-ip.sh.
+$TTL 3600
+@   IN SOA ns1.local-ip.sh. admin.local-ip.sh. (
+           2024010101 ; serial
+           3600 600 86400 300 )
+@   IN NS  ns1.local-ip.sh.
+www IN A   10.0.0.1
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err = parseZoneFile(zoneFile, "local-ip.sh.")
+	if err != nil || len(records["www.local-ip.sh."].A) != 1 {
+		t.Fatalf("Expected the SOA and NS records to be skipped, received %v %v", records, err)
+	}
+
+	err = os.WriteFile(zoneFile, []byte(`@ IN SOA ns1.local-ip.sh. admin.local-ip.sh. (
+        2024010101 3600 600 86400 300 )
+
+blog IN TXT "blog"
+blog IN CNAME www
+; the record after a multi-line one
+_x._tcp IN SRV ( 0 1 993
+                 mail.example.com. )
+x._tcp IN HINFO "cpu" "os"
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parseZoneFile(zoneFile, "local-ip.sh.")
+	if err == nil || !strings.Contains(err.Error(), zoneFile+":5: blog.local-ip.sh. has a CNAME record and other records") || !strings.Contains(err.Error(), zoneFile+":9: unsupported record type HINFO") {
+		t.Fatalf("Expected errors on lines 5 and 9, received %v", err)
+	}
+}
+
+func TestRecordSetUnit(t *testing.T) {
+	set := newRecordSet("local-ip.sh.", map[string]hardcodedRecord{
+		"local-ip.sh.":                   {TXT: []string{"apex"}},
+		"_imaps._tcp.local-ip.sh.":       {TXT: []string{"srv"}},
+		"*.local-ip.sh.":                 {TXT: []string{"wildcard"}},
+		"host.sub.local-ip.sh.":          {TXT: []string{"host"}},
+		"*.sub.local-ip.sh.":             {TXT: []string{"sub wildcard"}},
+		"_acme-challenge.local-ip.sh.":   {TXT: []string{}},
+		"ns1.other.test.":                {A: []net.IP{net.IPv4(1, 2, 3, 4)}},
+		"empty.descendant.local-ip.sh.":  {},
+		"deep.sub.wild.local-ip.sh.":     {TXT: []string{"deep"}},
+		"www.deep.sub.wild.local-ip.sh.": {},
+	})
+
+	for name, expected := range map[string]struct {
+		txt    string
+		exists bool
+	}{
+		"local-ip.sh.":                   {"apex", true},
+		"_tcp.local-ip.sh.":              {"", true},
+		"_imaps._tcp.local-ip.sh.":       {"srv", true},
+		"_pop3._tcp.local-ip.sh.":        {"", false},
+		"anything.local-ip.sh.":          {"wildcard", true},
+		"a.b.local-ip.sh.":               {"wildcard", true},
+		"sub.local-ip.sh.":               {"", true},
+		"descendant.local-ip.sh.":        {"wildcard", true},
+		"other.sub.local-ip.sh.":         {"sub wildcard", true},
+		"_acme-challenge.local-ip.sh.":   {"wildcard", true},
+		"wild.local-ip.sh.":              {"", true},
+		"other.wild.local-ip.sh.":        {"", false},
+		"www.deep.sub.wild.local-ip.sh.": {"", false},
+		"other.test.":                    {"", false},
+		"ylocal-ip.sh.":                  {"", false},
+	} {
+		records, exists := set.lookup(name)
+		txt := ""
+		if len(records.TXT) > 0 {
+			txt = records.TXT[0]
+		}
+		if txt != expected.txt || exists != expected.exists {
+			t.Errorf("Expected %q and %v for %s but received %q and %v", expected.txt, expected.exists, name, txt, exists)
+		}
+	}
+
+	if records, exists := set.lookup("ns1.other.test."); !exists || len(records.A) != 1 {
+		t.Errorf("Expected names outside of the zone to be found by their exact name, received %+v", records)
+	}
+}
+
+func TestReloadStaticRecordsUnit(t *testing.T) {
+	zoneFile := filepath.Join(t.TempDir(), "zone")
+	err := os.WriteFile(zoneFile, []byte("www IN A 10.0.0.1\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithDnsPort(9053),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+		WithZoneFile(zoneFile),
+	)
+
+	err = os.WriteFile(zoneFile, []byte("www IN A 10.0.0.2\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xip.ReloadStaticRecords(); err != nil {
+		t.Fatal(err)
+	}
+	if A := xip.fqdnToA("www.local-ip.sh."); len(A) != 1 || A[0].A.String() != "10.0.0.2" {
+		t.Fatalf("Expected the reloaded record, received %v", A)
+	}
+	if A := xip.fqdnToA("ns1.local-ip.sh."); len(A) != 1 || A[0].A.String() != "1.2.3.4" {
+		t.Fatalf("Expected name servers to survive the reload, received %v", A)
+	}
+
+	err = os.WriteFile(zoneFile, []byte("www IN NS ns1.local-ip.sh.\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xip.ReloadStaticRecords(); err == nil {
+		t.Fatal("Expected an invalid zone file to be rejected")
+	}
+	if A := xip.fqdnToA("www.local-ip.sh."); len(A) != 1 || A[0].A.String() != "10.0.0.2" {
+		t.Fatalf("Expected the previous records to be kept, received %v", A)
+	}
+
+	// the ACME challenges are answered by the server, they can't be CNAMEs
+	err = os.WriteFile(zoneFile, []byte("_acme-challenge IN CNAME challenges.example.com.\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xip.ReloadStaticRecords(); err == nil || !strings.Contains(err.Error(), "_acme-challenge.local-ip.sh. has a CNAME record") {
+		t.Fatalf("Expected a CNAME conflicting with the dynamic records to be rejected, received %v", err)
+	}
+	if A := xip.fqdnToA("www.local-ip.sh."); len(A) != 1 || A[0].A.String() != "10.0.0.2" {
+		t.Fatalf("Expected the previous records to be kept, received %v", A)
+	}
+
+	added, removed := diffRecords(
+		map[string]hardcodedRecord{"www.local-ip.sh.": {TXT: []string{"a", "b"}}},
+		map[string]hardcodedRecord{"www.local-ip.sh.": {TXT: []string{"b", "c"}}},
+	)
+	if !slices.Equal(added, []string{`www.local-ip.sh. TXT "c"`}) || !slices.Equal(removed, []string{`www.local-ip.sh. TXT "a"`}) {
+		t.Fatalf("Unexpected diff %v %v", added, removed)
+	}
+}
+
+func TestWatchStaticRecordsUnit(t *testing.T) {
+	// lay out the zone file like a Kubernetes ConfigMap volume
+	dir := t.TempDir()
+	writeVersion := func(version string, ip string) {
+		if err := os.Mkdir(filepath.Join(dir, version), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, version, "zone"), []byte("www IN A "+ip+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(version, filepath.Join(dir, "..data_tmp")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeVersion("..v1", "10.0.0.1")
+	zoneFile := filepath.Join(dir, "zone")
+	if err := os.Symlink(filepath.Join("..data", "zone"), zoneFile); err != nil {
+		t.Fatal(err)
+	}
+
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithDnsPort(9053),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+		WithZoneFile(zoneFile),
+	)
+	go xip.WatchStaticRecords(t.Context())
+	time.Sleep(100 * time.Millisecond)
+
+	writeVersion("..v2", "10.0.0.2")
+	for range 50 {
+		if A := xip.fqdnToA("www.local-ip.sh."); len(A) == 1 && A[0].A.String() == "10.0.0.2" {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Expected the records of the swapped zone file, received %v", xip.fqdnToA("www.local-ip.sh."))
+}
+
+func TestTTLsUnit(t *testing.T) {
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithEmail("admin@local-ip.sh"),
+		WithDnsPort(9053),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+		WithTTLs(TTLs{
+			Default:     time.Hour,
+			Synthesized: 24 * time.Hour,
+			Types:       map[uint16]time.Duration{dns.TypeTXT: time.Minute},
+			Names:       map[string]time.Duration{"_dmarc.local-ip.sh.": 10 * time.Second},
+			SOAMinimum:  30 * time.Second,
+		}),
+	)
+
+	for _, test := range []struct {
+		name  string
+		qtype uint16
+		ttl   uint32
+	}{
+		{"192-168-1-29.local-ip.sh.", dns.TypeA, 86400},
+		{"ns1.local-ip.sh.", dns.TypeA, 3600},
+		{"dkim._domainkey.local-ip.sh.", dns.TypeTXT, 60},
+		{"_DMARC.local-ip.sh.", dns.TypeTXT, 10},
+		{"local-ip.sh.", dns.TypeMX, 3600},
+	} {
+		response := xip.respond(new(dns.Msg).SetQuestion(test.name, test.qtype), "udp")
+		if len(response.Answer) == 0 || response.Answer[0].Header().Ttl != test.ttl {
+			t.Errorf("Expected a TTL of %d for %s, received %s", test.ttl, test.name, response)
+		}
+	}
+
+	response := xip.respond(new(dns.Msg).SetQuestion("nothing.local-ip.sh.", dns.TypeA), "udp")
+	soa := response.Ns[0].(*dns.SOA)
+	if soa.Minttl != 30 || soa.Hdr.Ttl != 30 || soa.Refresh != 900 {
+		t.Errorf("Unexpected negative caching SOA %s", soa)
+	}
+}
+
+func TestNegativeAnswersUnit(t *testing.T) {
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithEmail("admin@local-ip.sh"),
+		WithDnsPort(9053),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+	)
+
+	for _, test := range []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+	}{
+		{"10-0-0-1.local-ip.sh.", dns.TypeAAAA, dns.RcodeSuccess, 0},
+		{"fe80--1.local-ip.sh.", dns.TypeA, dns.RcodeSuccess, 0},
+		{"10-0-0-1.local-ip.sh.", dns.TypeHINFO, dns.RcodeSuccess, 0},
+		{"10-0-0-1.local-ip.sh.", dns.TypeSOA, dns.RcodeSuccess, 0},
+		{"10-0-0-1.local-ip.sh.", dns.TypeNS, dns.RcodeSuccess, 0},
+		{"_tcp.local-ip.sh.", dns.TypeSRV, dns.RcodeSuccess, 0},
+		{"_tcp.local-ip.sh.", dns.TypeA, dns.RcodeSuccess, 0},
+		{"nothing.local-ip.sh.", dns.TypeA, dns.RcodeNameError, 0},
+		{"nothing.local-ip.sh.", dns.TypeTXT, dns.RcodeNameError, 0},
+		{"nothing.local-ip.sh.", dns.TypeHINFO, dns.RcodeNameError, 0},
+		{"autodiscover.local-ip.sh.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"local-ip.sh.", dns.TypeSOA, dns.RcodeSuccess, 1},
+		{"local-ip.sh.", dns.TypeHINFO, dns.RcodeSuccess, 0},
+	} {
+		response := xip.respond(new(dns.Msg).SetQuestion(test.name, test.qtype), "udp")
+		if response.Rcode != test.rcode || len(response.Answer) != test.answers {
+			t.Errorf("Expected %s with %d answers for %s %s, received %s", dns.RcodeToString[test.rcode], test.answers, test.name, dns.TypeToString[test.qtype], response)
+			continue
+		}
+		if test.answers == 0 {
+			if len(response.Ns) != 1 || response.Ns[0].Header().Rrtype != dns.TypeSOA || response.Ns[0].Header().Name != "local-ip.sh." {
+				t.Errorf("Expected the zone's SOA in the authority section for %s %s, received %s", test.name, dns.TypeToString[test.qtype], response)
+			}
+		}
+	}
+}
+
+func TestAnyUnit(t *testing.T) {
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithEmail("admin@local-ip.sh"),
+		WithDnsPort(9053),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+		WithAnyResponse(AnyResponseTCP),
+	)
+
+	request := new(dns.Msg).SetQuestion("local-ip.sh.", dns.TypeANY)
+	response := xip.respond(request, "udp")
+	if len(response.Answer) != 1 || response.Answer[0].(*dns.HINFO).Cpu != "RFC8482" {
+		t.Fatalf("Expected a single HINFO record, received %s", response)
+	}
+
+	response = xip.respond(request, "tcp")
+	types := map[uint16]bool{}
+	for _, answer := range response.Answer {
+		types[answer.Header().Rrtype] = true
+	}
+	for _, rrtype := range []uint16{dns.TypeSOA, dns.TypeNS, dns.TypeMX, dns.TypeTXT} {
+		if !types[rrtype] {
+			t.Errorf("Expected %s records over TCP, received %s", dns.TypeToString[rrtype], response)
+		}
+	}
+
+	response = xip.respond(new(dns.Msg).SetQuestion("nothing.local-ip.sh.", dns.TypeANY), "udp")
+	if response.Rcode != dns.RcodeNameError {
+		t.Fatalf("Expected NXDOMAIN, received %s", response)
+	}
+}
+
+func TestCAAUnit(t *testing.T) {
+	if issuer := caaIssuerFromDirectory("https://acme-staging-v02.api.letsencrypt.org/directory"); issuer != "letsencrypt.org" {
+		t.Errorf("Expected letsencrypt.org, received %s", issuer)
+	}
+	if issuer := caaIssuerFromDirectory("https://acme.example.com/directory"); issuer != "example.com" {
+		t.Errorf("Expected example.com, received %s", issuer)
+	}
+
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithEmail("admin@local-ip.sh"),
+		WithDnsPort(9053),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+		WithCAAIssuer("letsencrypt.org"),
+		WithCAAAccountPinning(true),
+	)
+
+	caaValues := func() []string {
+		var values []string
+		response := xip.respond(new(dns.Msg).SetQuestion("local-ip.sh.", dns.TypeCAA), "udp")
+		for _, answer := range response.Answer {
+			caa := answer.(*dns.CAA)
+			values = append(values, caa.Tag+" "+caa.Value)
+		}
+		return values
+	}
+
+	expected := []string{"issue letsencrypt.org", "issuewild letsencrypt.org", "iodef mailto:admin@local-ip.sh"}
+	if values := caaValues(); !slices.Equal(values, expected) {
+		t.Fatalf("Expected %v, received %v", expected, values)
+	}
+
+	xip.SetCAAAccountURI("https://acme-v02.api.letsencrypt.org/acme/acct/42")
+	expected = []string{
+		"issue letsencrypt.org; accounturi=https://acme-v02.api.letsencrypt.org/acme/acct/42",
+		"issuewild letsencrypt.org; accounturi=https://acme-v02.api.letsencrypt.org/acme/acct/42",
+		"iodef mailto:admin@local-ip.sh",
+	}
+	if values := caaValues(); !slices.Equal(values, expected) {
+		t.Fatalf("Expected %v, received %v", expected, values)
+	}
+}
+
+func TestRateLimitUnit(t *testing.T) {
+	rateLimiter := newRateLimiter(RateLimitConfig{
+		ResponsesPerSecond: 5,
+		NxdomainsPerSecond: 2,
+		Window:             time.Second,
+		Slip:               2,
+		Exempt:             []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+	answer := new(dns.Msg).SetQuestion("1-2-3-4.local-ip.sh.", dns.TypeA)
+	nxdomain := new(dns.Msg).SetQuestion("nothing.local-ip.sh.", dns.TypeA)
+	nxdomain.Rcode = dns.RcodeNameError
+
+	actions := func(client string, message *dns.Msg, count int) map[rateLimitAction]int {
+		addr := net.UDPAddrFromAddrPort(netip.MustParseAddrPort(client))
+		actions := map[rateLimitAction]int{}
+		for range count {
+			actions[rateLimiter.check(addr, message)]++
+		}
+		return actions
+	}
+
+	if result := actions("192.0.2.1:53000", answer, 9); result[rateLimitAllow] != 5 || result[rateLimitSlip] != 2 || result[rateLimitDrop] != 2 {
+		t.Errorf("Expected 5 allowed, 2 slipped and 2 dropped answers, received %v", result)
+	}
+	// same /24, same account
+	if result := actions("192.0.2.200:53000", answer, 1); result[rateLimitAllow] != 0 {
+		t.Errorf("Expected the client network to be limited, received %v", result)
+	}
+	if result := actions("192.0.2.1:53000", nxdomain, 3); result[rateLimitAllow] != 2 {
+		t.Errorf("Expected 2 allowed NXDOMAIN, received %v", result)
+	}
+	if result := actions("198.51.100.1:53000", answer, 5); result[rateLimitAllow] != 5 {
+		t.Errorf("Expected another client network to be allowed, received %v", result)
+	}
+	if result := actions("10.1.2.3:53000", answer, 20); result[rateLimitAllow] != 20 {
+		t.Errorf("Expected exempt clients to be allowed, received %v", result)
+	}
+
+	stats := rateLimiter.stats()
+	if stats.Allowed != 32 || stats.Slipped != 2 || stats.Dropped != 4 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// the limit of all responses alone, other kinds having no account
+	rateLimiter = newRateLimiter(RateLimitConfig{AllPerSecond: 1, Window: time.Second, Slip: 2})
+	if result := actions("192.0.2.1:53000", nxdomain, 5); result[rateLimitAllow] != 1 || result[rateLimitSlip] != 2 || result[rateLimitDrop] != 2 {
+		t.Errorf("Expected 1 allowed, 2 slipped and 2 dropped responses, received %v", result)
+	}
+
+	// random names from spoofed networks don't grow the accounts past the cap
+	rateLimiter = newRateLimiter(RateLimitConfig{ResponsesPerSecond: 5, Window: time.Second})
+	rateLimiter.maxAccounts = 100
+	for i := range 1000 {
+		message := new(dns.Msg).SetQuestion(fmt.Sprintf("random-%d.local-ip.sh.", i), dns.TypeA)
+		addr := net.UDPAddrFromAddrPort(netip.AddrPortFrom(netip.AddrFrom4([4]byte{192, 0, byte(i >> 8), byte(i)}), 53000))
+		rateLimiter.check(addr, message)
+	}
+	if len(rateLimiter.accounts) != 100 || rateLimiter.recent.Len() != 100 {
+		t.Errorf("Expected 100 accounts, tracking %d", len(rateLimiter.accounts))
+	}
+
+	answer.SetEdns0(1232, false)
+	answer.Extra = append(answer.Extra, &dns.A{Hdr: dns.RR_Header{Name: "ns1.local-ip.sh.", Rrtype: dns.TypeA, Class: dns.ClassINET}})
+	slipResponse(answer)
+	if !answer.Truncated || len(answer.Answer) != 0 || len(answer.Extra) != 1 || answer.IsEdns0() == nil {
+		t.Errorf("Expected an empty truncated response keeping its OPT record, received %s", answer)
+	}
+}
+
+func TestMetricsUnit(t *testing.T) {
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithEmail("admin@local-ip.sh"),
+		WithDnsPort(9053),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+	)
+
+	for _, fqdn := range []string{"192-168-1-29.local-ip.sh.", "c0a8011d.local-ip.sh.", "ns1.local-ip.sh."} {
+		request := new(dns.Msg).SetQuestion(fqdn, dns.TypeA)
+		xip.metrics.observeRequest(request, xip.respond(request, "udp"), "udp", time.Now())
+	}
+
+	recorder := httptest.NewRecorder()
+	xip.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, line := range []string{
+		`local_ip_dns_requests_total{qtype="A",rcode="NOERROR",transport="udp"} 3`,
+		`local_ip_dns_address_answers_total{encoding="dashed",qtype="A"} 1`,
+		`local_ip_dns_address_answers_total{encoding="hex",qtype="A"} 1`,
+		`local_ip_dns_address_answers_total{encoding="static",qtype="A"} 1`,
+		`local_ip_dns_request_duration_seconds_count{transport="udp"} 3`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected %s in metrics, received %s", line, body)
+		}
+	}
+}
+
+type testResponseWriter struct {
+	dns.ResponseWriter
+	local  net.Addr
+	remote net.Addr
+}
+
+func (w testResponseWriter) LocalAddr() net.Addr  { return w.local }
+func (w testResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+func TestDnstapUnit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	logger, err := newDnstapLogger("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newDnstapLogger("tcp:127.0.0.1:6000"); err == nil {
+		t.Error("Expected an error for an unsupported output")
+	}
+
+	response := testResponseWriter{
+		local:  &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53},
+		remote: &net.UDPAddr{IP: net.ParseIP("198.51.100.7"), Port: 40000},
+	}
+	request := new(dns.Msg).SetQuestion("192-168-1-29.local-ip.sh.", dns.TypeA)
+	reply := new(dns.Msg).SetReply(request)
+	logger.logQuery(response, request, time.Now())
+	logger.logResponse(response, request, reply, time.Now())
+	logger.close()
+	// queries still answered once closed are not logged
+	logger.logQuery(response, request, time.Now())
+
+	input, err := dnstap.NewFrameStreamInputFromFilename(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := make(chan []byte, 2)
+	input.ReadInto(frames)
+	close(frames)
+
+	var types []dnstap.Message_Type
+	for frame := range frames {
+		var payload dnstap.Dnstap
+		if err := proto.Unmarshal(frame, &payload); err != nil {
+			t.Fatal(err)
+		}
+		message := payload.GetMessage()
+		types = append(types, message.GetType())
+		if message.GetSocketProtocol() != dnstap.SocketProtocol_UDP || net.IP(message.GetQueryAddress()).String() != "198.51.100.7" || message.GetQueryPort() != 40000 {
+			t.Errorf("Unexpected dnstap message %v", message)
+		}
+		query := new(dns.Msg)
+		if err := query.Unpack(message.GetQueryMessage()); err != nil || query.Question[0].Name != "192-168-1-29.local-ip.sh." {
+			t.Errorf("Unexpected query message %v", query)
+		}
+	}
+	if !slices.Equal(types, []dnstap.Message_Type{dnstap.Message_AUTH_QUERY, dnstap.Message_AUTH_RESPONSE}) {
+		t.Errorf("Expected AUTH_QUERY and AUTH_RESPONSE, received %v", types)
+	}
+}
+
+func TestDohUnit(t *testing.T) {
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithEmail("admin@local-ip.sh"),
+		WithDnsPort(9053),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+	)
+	handler := xip.DohHandler()
+
+	query, err := new(dns.Msg).SetQuestion("192-168-1-29.local-ip.sh.", dns.TypeA).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := httptest.NewRequest("GET", "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+	post := httptest.NewRequest("POST", "/dns-query", bytes.NewReader(query))
+	post.Header.Set("Content-Type", "application/dns-message")
+	for _, request := range []*http.Request{get, post} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/dns-message" {
+			t.Fatalf("Unexpected %s response %d %v", request.Method, recorder.Code, recorder.Header())
+		}
+		if cacheControl := recorder.Header().Get("Cache-Control"); cacheControl != "max-age=300" {
+			t.Errorf("Expected max-age=300, received %s", cacheControl)
+		}
+		response := new(dns.Msg)
+		if err := response.Unpack(recorder.Body.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != "192.168.1.29" {
+			t.Errorf("Unexpected %s response %s", request.Method, response)
+		}
+	}
+
+	invalidContentType := httptest.NewRequest("POST", "/dns-query", bytes.NewReader(query))
+	invalidContentType.Header.Set("Content-Type", "text/plain")
+	for request, status := range map[*http.Request]int{
+		httptest.NewRequest("GET", "/dns-query?dns=not-base64!", nil): http.StatusBadRequest,
+		httptest.NewRequest("GET", "/dns-query?dns=AAAA", nil):        http.StatusBadRequest,
+		invalidContentType: http.StatusUnsupportedMediaType,
+	} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != status {
+			t.Errorf("Expected %d for %s, received %d", status, request.URL, recorder.Code)
+		}
+	}
+}
+
 func TestResolveDashE2E(t *testing.T) {
 	xip := NewXip(
 		WithDomain("local-ip.sh"),
 		WithDnsPort(9053),
 		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
 	)
-	go xip.StartServer()
+	go xip.StartServer(t.Context())
 
 	cmd := exec.Command("dig", "@localhost", "-p", "9053", "192-168-1-29.local-ip.sh", "+short")
 	out, err := cmd.Output()
@@ -75,23 +950,605 @@ func TestResolveDashE2E(t *testing.T) {
 	}
 }
 
-func BenchmarkResolveDashBasic(b *testing.B) {
-	b.Skip()
+func TestResolveTCPE2E(t *testing.T) {
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithDnsPort(9054),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+	)
+	go xip.StartServer(t.Context())
+
+	client := &dns.Client{Net: "tcp"}
+	query := new(dns.Msg).SetQuestion("192-168-1-29.local-ip.sh.", dns.TypeA)
+	var response *dns.Msg
+	var err error
+	for range 50 {
+		response, _, err = client.Exchange(query, "127.0.0.1:9054")
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != "192.168.1.29" {
+		t.Fatal(response.String())
+	}
+}
+
+func TestDnsListenTCPE2E(t *testing.T) {
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithDnsListen([]string{"127.0.0.1:9067", "[::1]:9068"}),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+	)
+	go xip.StartServer(t.Context())
+
+	client := &dns.Client{Net: "tcp"}
+	query := new(dns.Msg).SetQuestion("192-168-1-29.local-ip.sh.", dns.TypeA)
+	for _, addr := range []string{"127.0.0.1:9067", "[::1]:9068"} {
+		var response *dns.Msg
+		var err error
+		for range 50 {
+			response, _, err = client.Exchange(query, addr)
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != "192.168.1.29" {
+			t.Fatalf("Unexpected response from %s: %s", addr, response)
+		}
+	}
+
+	if _, _, err := client.Exchange(query, "127.0.0.1:9068"); err == nil {
+		t.Error("Expected no server on addresses that aren't configured")
+	}
+}
+
+func TestDnsTcpListenTCPE2E(t *testing.T) {
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithDnsListen([]string{"127.0.0.1:9070"}),
+		WithDnsTcpListen([]string{"127.0.0.1:9071"}),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+	)
+	go xip.StartServer(t.Context())
+
+	query := new(dns.Msg).SetQuestion("192-168-1-29.local-ip.sh.", dns.TypeA)
+	for _, transport := range []struct{ net, addr string }{{"udp", "127.0.0.1:9070"}, {"tcp", "127.0.0.1:9071"}} {
+		client := &dns.Client{Net: transport.net}
+		var response *dns.Msg
+		var err error
+		for range 50 {
+			response, _, err = client.Exchange(query, transport.addr)
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != "192.168.1.29" {
+			t.Fatalf("Unexpected %s response from %s: %s", transport.net, transport.addr, response)
+		}
+	}
+
+	for _, transport := range []struct{ net, addr string }{{"tcp", "127.0.0.1:9070"}, {"udp", "127.0.0.1:9071"}} {
+		client := &dns.Client{Net: transport.net, Timeout: 200 * time.Millisecond}
+		if _, _, err := client.Exchange(query, transport.addr); err == nil {
+			t.Errorf("Expected no %s server on %s", transport.net, transport.addr)
+		}
+	}
+}
+func TestDnsSocketsTCPE2E(t *testing.T) {
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithDnsPort(9066),
+		WithDnsSockets(4),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+	)
+	if len(xip.servers) != 8 {
+		t.Fatalf("Expected 4 UDP and 4 TCP servers, received %d", len(xip.servers))
+	}
+	go xip.StartServer(t.Context())
+
+	query := new(dns.Msg).SetQuestion("192-168-1-29.local-ip.sh.", dns.TypeA)
+	for _, network := range []string{"udp", "tcp"} {
+		client := &dns.Client{Net: network}
+		var response *dns.Msg
+		var err error
+		for range 50 {
+			response, _, err = client.Exchange(query, "127.0.0.1:9066")
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != "192.168.1.29" {
+			t.Fatalf("Unexpected %s response %s", network, response)
+		}
+	}
+}
+
+func TestShutdownTCPE2E(t *testing.T) {
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithDnsPort(9062),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+	)
+	ctx, cancel := context.WithCancel(t.Context())
+	stopped := make(chan error, 1)
+	go func() { stopped <- xip.StartServer(ctx) }()
+
+	client := &dns.Client{Net: "tcp"}
+	query := new(dns.Msg).SetQuestion("192-168-1-29.local-ip.sh.", dns.TypeA)
+	var err error
+	for range 50 {
+		_, _, err = client.Exchange(query, "127.0.0.1:9062")
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(ShutdownTimeout):
+		t.Fatal("server did not shut down")
+	}
+
+	if _, _, err := client.Exchange(query, "127.0.0.1:9062"); err == nil {
+		t.Fatal("server still answering after shutdown")
+	}
+}
+
+func TestShutdownInFlightTCPE2E(t *testing.T) {
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithDnsPort(9069),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+		WithWorkers(2),
+	)
+	ctx, cancel := context.WithCancel(t.Context())
+	stopped := make(chan error, 1)
+	go func() { stopped <- xip.StartServer(ctx) }()
+
+	query := new(dns.Msg).SetQuestion("192-168-1-29.local-ip.sh.", dns.TypeA)
+	var err error
+	for range 50 {
+		_, _, err = (&dns.Client{Net: "tcp"}).Exchange(query, "127.0.0.1:9069")
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// keep the workers busy so that queries are in flight when the server
+	// shuts down
+	xip.pool.acquire(time.Now())
+	xip.pool.acquire(time.Now())
+	answers := make(chan error, 2)
+	for _, network := range []string{"udp", "tcp"} {
+		go func() {
+			response, _, err := (&dns.Client{Net: network}).Exchange(query, "127.0.0.1:9069")
+			if err == nil && len(response.Answer) != 1 {
+				err = fmt.Errorf("expected one answer over %s, received %s", network, response)
+			}
+			answers <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	xip.pool.release()
+	xip.pool.release()
+
+	for range 2 {
+		if err := <-answers; err != nil {
+			t.Error(err)
+		}
+	}
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testCertificate is a self-signed certificate for name.
+type testCertificate struct {
+	name        string
+	certificate *tls.Certificate
+}
+
+func newTestCertificate(t *testing.T, name string) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCertificate{name, &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}}
+}
+
+func (c *testCertificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.certificate, nil
+}
+
+func TestDotE2E(t *testing.T) {
+	xip := NewXip(
+		WithDomain("dot.test"),
+		WithEmail("admin@dot.test"),
+		WithDnsPort(9058),
+		WithDotPort(9059),
+		WithNameServers([]string{"1.2.3.4"}),
+		WithTLSCertificates(newTestCertificate(t, "dot.test"), newTestCertificate(t, "*.dot.test")),
+	)
+	go xip.StartServer(t.Context())
 
-	for i := 0; i < b.N; i++ {
-		port := 9053 + i
-		xip := NewXip(
-			WithDomain("local-ip.sh"),
-			WithDnsPort(uint(port)),
-			WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
-		)
-		go xip.StartServer()
+	for serverName, expected := range map[string]string{"ns1.dot.test": "*.dot.test", "dot.test": "dot.test"} {
+		client := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true}}
+		query := new(dns.Msg).SetQuestion("192-168-1-29.dot.test.", dns.TypeA)
+		var response *dns.Msg
+		var err error
+		for range 50 {
+			response, _, err = client.Exchange(query, "127.0.0.1:9059")
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != "192.168.1.29" {
+			t.Fatal(response.String())
+		}
 
-		cmd := exec.Command("dig", "@localhost", "-p", fmt.Sprint(port), "192-168-1-29.local-ip.sh", "+short")
-		cmd.Run()
+		conn, err := tls.Dial("tcp", "127.0.0.1:9059", client.TLSConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; name != expected {
+			t.Errorf("Expected the %s certificate for %s, received %s", expected, serverName, name)
+		}
+		conn.Close()
 	}
 }
 
+func TestDoqE2E(t *testing.T) {
+	xip := NewXip(
+		WithDomain("doq.test"),
+		WithEmail("admin@doq.test"),
+		WithDnsPort(9060),
+		WithDoqPort(9061),
+		WithNameServers([]string{"1.2.3.4"}),
+		WithTLSCertificates(newTestCertificate(t, "doq.test"), newTestCertificate(t, "*.doq.test")),
+	)
+	go xip.StartServer(t.Context())
+
+	tlsConfig := &tls.Config{ServerName: "ns1.doq.test", NextProtos: []string{"doq"}, InsecureSkipVerify: true}
+	var conn *quic.Conn
+	var err error
+	for range 50 {
+		conn, err = quic.DialAddr(context.Background(), "127.0.0.1:9061", tlsConfig, nil)
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+
+	exchange := func(query *dns.Msg) (*dns.Msg, error) {
+		stream, err := conn.OpenStreamSync(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		packed, err := query.Pack()
+		if err != nil {
+			return nil, err
+		}
+		stream.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packed))), packed...))
+		stream.Close()
+
+		raw, err := io.ReadAll(stream)
+		if err != nil {
+			return nil, err
+		}
+		if len(raw) < 2 || int(binary.BigEndian.Uint16(raw)) != len(raw)-2 {
+			return nil, fmt.Errorf("invalid response length in %v", raw)
+		}
+		response := new(dns.Msg)
+		return response, response.Unpack(raw[2:])
+	}
+
+	query := new(dns.Msg).SetQuestion("192-168-1-29.doq.test.", dns.TypeA)
+	query.Id = 0
+	response, err := exchange(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Id != 0 || len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != "192.168.1.29" {
+		t.Fatal(response.String())
+	}
+
+	// queries with a non-zero ID are protocol errors closing the connection
+	query.Id = 42
+	if _, err := exchange(query); err == nil {
+		t.Fatal("Expected the connection to be closed")
+	}
+	<-conn.Context().Done()
+}
+
+func TestTransferE2E(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString([]byte("a secret only secondaries know"))
+	xip := NewXip(
+		WithDomain("transfer.test"),
+		WithEmail("admin@transfer.test"),
+		WithDnsListen([]string{"127.0.0.1:9055"}),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+		WithSecondaries([]string{"127.0.0.1:9057"}),
+		WithTsigKey("transfer:"+secret),
+	)
+	go xip.StartServer(t.Context())
+
+	transfer := func(query *dns.Msg) ([]dns.RR, error) {
+		transfer := &dns.Transfer{TsigSecret: map[string]string{"transfer.": secret, "Transfer.": secret}}
+		var envelopes chan *dns.Envelope
+		var err error
+		for range 50 {
+			envelopes, err = transfer.In(query, "127.0.0.1:9055")
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var records []dns.RR
+		for envelope := range envelopes {
+			if envelope.Error != nil {
+				return nil, envelope.Error
+			}
+			records = append(records, envelope.RR...)
+		}
+		return records, nil
+	}
+
+	query := new(dns.Msg).SetAxfr("transfer.test.")
+	query.SetTsig("transfer.", dns.HmacSHA256, 300, time.Now().Unix())
+	records, err := transfer(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, firstIsSoa := records[0].(*dns.SOA)
+	_, lastIsSoa := records[len(records)-1].(*dns.SOA)
+	if !firstIsSoa || !lastIsSoa || len(records) < 5 {
+		t.Fatalf("Expected a transfer framed by SOA records, received %v", records)
+	}
+	for _, record := range records {
+		if !dns.IsSubDomain("transfer.test.", record.Header().Name) {
+			t.Errorf("Expected only records of the zone, received %s", record)
+		}
+	}
+
+	query = new(dns.Msg).SetIxfr("transfer.test.", first.Serial, first.Ns, first.Mbox)
+	query.SetTsig("transfer.", dns.HmacSHA256, 300, time.Now().Unix())
+	records, err = transfer(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("Expected a single SOA for an up to date secondary, received %v", records)
+	}
+
+	_, err = transfer(new(dns.Msg).SetAxfr("transfer.test."))
+	if err == nil {
+		t.Fatal("Expected an unsigned transfer to be refused")
+	}
+
+	// key names are domain names, whatever their case
+	query = new(dns.Msg).SetAxfr("transfer.test.")
+	query.SetTsig("Transfer.", dns.HmacSHA256, 300, time.Now().Unix())
+	if _, err := transfer(query); err != nil {
+		t.Fatalf("Expected the key name to match regardless of case, received %v", err)
+	}
+}
+
+func TestWorkerPoolUnit(t *testing.T) {
+	pool := newWorkerPool(1)
+	if !pool.acquire(time.Now().Add(time.Second)) {
+		t.Fatal("Expected a free worker")
+	}
+	start := time.Now()
+	if pool.acquire(time.Now().Add(20 * time.Millisecond)) {
+		t.Fatal("Expected no free worker")
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("Expected acquire to wait for a worker until the deadline")
+	}
+
+	// one query waiting already, the next one is dropped right away
+	waiting := make(chan bool)
+	go func() { waiting <- pool.acquire(time.Now().Add(time.Second)) }()
+	for len(pool.waiting) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	start = time.Now()
+	if pool.acquire(time.Now().Add(time.Second)) || time.Since(start) > 100*time.Millisecond {
+		t.Fatal("Expected the query to be dropped without waiting")
+	}
+	pool.release()
+	if !<-waiting {
+		t.Fatal("Expected the waiting query to get the released worker")
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		pool.release()
+	}()
+	if !pool.acquire(time.Now().Add(time.Second)) {
+		t.Fatal("Expected the released worker")
+	}
+
+	// a query finding no free worker is dropped without being answered
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithNameServers([]string{"1.2.3.4"}),
+		WithWorkers(1),
+		WithQueryTimeout(10*time.Millisecond),
+	)
+	xip.pool.acquire(time.Now())
+	request := new(dns.Msg).SetQuestion("192-168-1-29.local-ip.sh.", dns.TypeA)
+	xip.handleDnsRequest(discardResponseWriter{}, request)
+	if dropped := testutil.ToFloat64(xip.metrics.dropped.WithLabelValues(dropOverloaded)); dropped != 1 {
+		t.Errorf("Expected 1 dropped query, received %v", dropped)
+	}
+
+	// so do DNS over HTTPS ones, with an HTTP error
+	query, err := request.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	xip.DohHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(query), nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d, received %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+	if dropped := testutil.ToFloat64(xip.metrics.dropped.WithLabelValues(dropOverloaded)); dropped != 2 {
+		t.Errorf("Expected 2 dropped queries, received %v", dropped)
+	}
+}
+
+// quietLogs mutes the logs for the duration of a benchmark, to measure
+// answering rather than writing to the console.
+func quietLogs(b *testing.B) {
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	b.Cleanup(func() { zerolog.SetGlobalLevel(level) })
+}
+
+// discardResponseWriter answers into the void, for benchmarks.
+type discardResponseWriter struct {
+	testResponseWriter
+}
+
+func (w discardResponseWriter) Write(packed []byte) (int, error) { return len(packed), nil }
+
+func (w discardResponseWriter) WriteMsg(message *dns.Msg) error {
+	_, err := message.Pack()
+	return err
+}
+
+func BenchmarkResolveA(b *testing.B) {
+	quietLogs(b)
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+	)
+
+	for _, fqdn := range []string{
+		"192-168-1-29.local-ip.sh.",
+		"app.192.168.1.29.local-ip.sh.",
+		"c0a8011d.local-ip.sh.",
+		"3232235805.local-ip.sh.",
+		"nothing.local-ip.sh.",
+	} {
+		b.Run(fqdn, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				xip.fqdnToA(fqdn)
+			}
+		})
+	}
+}
+
+func BenchmarkServeDNS(b *testing.B) {
+	quietLogs(b)
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+	)
+	response := discardResponseWriter{testResponseWriter{
+		local:  &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53},
+		remote: &net.UDPAddr{IP: net.ParseIP("198.51.100.7"), Port: 40000},
+	}}
+	request := new(dns.Msg).SetQuestion("192-168-1-29.local-ip.sh.", dns.TypeA)
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			xip.serveDNS(response, request)
+		}
+	})
+}
+
+func BenchmarkServeUDP(b *testing.B) {
+	quietLogs(b)
+	xip := NewXip(
+		WithDomain("local-ip.sh"),
+		WithDnsPort(9065),
+		WithNameServers([]string{"1.2.3.4", "5.6.7.8"}),
+	)
+	go xip.StartServer(b.Context())
+
+	client := new(dns.Client)
+	query := new(dns.Msg).SetQuestion("192-168-1-29.local-ip.sh.", dns.TypeA)
+	var err error
+	for range 50 {
+		if _, _, err = client.Exchange(query, "127.0.0.1:9065"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		client := new(dns.Client)
+		for pb.Next() {
+			if _, _, err := client.Exchange(query, "127.0.0.1:9065"); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
 func TestInstanceIsolation(t *testing.T) {
 	xip1 := NewXip(
 		WithDomain("one.test"),
@@ -104,7 +1561,7 @@ func TestInstanceIsolation(t *testing.T) {
 		WithNameServers([]string{"2.2.2.2"}),
 	)
 
-	if xip1.records == nil || xip2.records == nil {
+	if xip1.records.Load() == nil || xip2.records.Load() == nil {
 		t.Fatal("records not initialized")
 	}
 
@@ -115,17 +1572,62 @@ func TestInstanceIsolation(t *testing.T) {
 		t.Errorf("xip2 nameservers incorrect: %v", xip2.nameServers)
 	}
 
-	if _, ok := xip1.records["ns1.one.test."]; !ok {
+	if _, ok := xip1.records.Load().names["ns1.one.test."]; !ok {
 		t.Error("xip1 missing ns1.one.test. record")
 	}
-	if _, ok := xip2.records["ns1.two.test."]; !ok {
+	if _, ok := xip2.records.Load().names["ns1.two.test."]; !ok {
 		t.Error("xip2 missing ns1.two.test. record")
 	}
 
-	if _, ok := xip1.records["ns1.two.test."]; ok {
+	if _, ok := xip1.records.Load().names["ns1.two.test."]; ok {
 		t.Error("xip1 should not have xip2's records")
 	}
-	if _, ok := xip2.records["ns1.one.test."]; ok {
+	if _, ok := xip2.records.Load().names["ns1.one.test."]; ok {
 		t.Error("xip2 should not have xip1's records")
 	}
 }
+
+func TestInstanceRoutingIsolation(t *testing.T) {
+	xip1 := NewXip(
+		WithDomain("same.test"),
+		WithDnsPort(9063),
+		WithNameServers([]string{"1.1.1.1"}),
+	)
+	xip2 := NewXip(
+		WithDomain("same.test"),
+		WithDnsPort(9064),
+		WithNameServers([]string{"2.2.2.2"}),
+	)
+	go xip1.StartServer(t.Context())
+	go xip2.StartServer(t.Context())
+
+	exchange := func(name string, addr string) *dns.Msg {
+		client := &dns.Client{Net: "tcp"}
+		query := new(dns.Msg).SetQuestion(name, dns.TypeA)
+		var response *dns.Msg
+		var err error
+		for range 50 {
+			response, _, err = client.Exchange(query, addr)
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	for addr, expected := range map[string]string{"127.0.0.1:9063": "1.1.1.1", "127.0.0.1:9064": "2.2.2.2"} {
+		response := exchange("ns1.same.test.", addr)
+		if len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != expected {
+			t.Errorf("%s answered %s", addr, response.String())
+		}
+
+		response = exchange("192-168-1-29.example.com.", addr)
+		if response.Rcode != dns.RcodeRefused || len(response.Answer) != 0 {
+			t.Errorf("%s answered out-of-zone query with %s", addr, response.String())
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package xip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+	"local-ip.sh/utils"
+)
+
+// parseZoneFile reads static records from an RFC 1035 zone file. Relative
+// names and $ORIGIN directives are resolved against zone. The SOA and NS
+// records of the apex are skipped since the server synthesizes its own.
+// Every record that can't be served is reported with its line number.
+func parseZoneFile(path string, zone string) (map[string]hardcodedRecord, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read zone file: %w", err)
+	}
+
+	records := map[string]hardcodedRecord{}
+	// cnameLines is the line of the CNAME record of each name that has one
+	cnameLines := map[string]int{}
+	var errs []error
+	reader := &zoneLineReader{reader: bytes.NewReader(content), line: 1}
+	parser := dns.NewZoneParser(reader, zone, path)
+	line := 0
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		// records generated by $GENERATE all come from the same line
+		if start := reader.entryLine(); start != 0 {
+			line = start
+		}
+
+		name := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(zone, name) {
+			errs = append(errs, fmt.Errorf("%s:%d: %s is outside of zone %s", path, line, rr.Header().Name, zone))
+			continue
+		}
+
+		entry := records[name]
+		switch rr := rr.(type) {
+		case *dns.A:
+			entry.A = append(entry.A, rr.A)
+		case *dns.AAAA:
+			entry.AAAA = append(entry.AAAA, rr.AAAA)
+		case *dns.TXT:
+			entry.TXT = append(entry.TXT, strings.Join(rr.Txt, ""))
+		case *dns.MX:
+			entry.MX = append(entry.MX, rr)
+		case *dns.CNAME:
+			if name == zone {
+				errs = append(errs, fmt.Errorf("%s:%d: CNAME is not allowed at the zone apex", path, line))
+				continue
+			}
+			if len(entry.CNAME) > 0 {
+				errs = append(errs, fmt.Errorf("%s:%d: %s has more than one CNAME record", path, line, name))
+				continue
+			}
+			entry.CNAME = append(entry.CNAME, rr.Target)
+			cnameLines[name] = line
+		case *dns.SRV:
+			entry.SRV = append(entry.SRV, rr)
+		case *dns.CAA:
+			entry.CAA = append(entry.CAA, rr)
+		case *dns.SOA, *dns.NS:
+			if name != zone {
+				errs = append(errs, fmt.Errorf("%s:%d: unsupported record type %s", path, line, dns.TypeToString[rr.Header().Rrtype]))
+				continue
+			}
+			utils.Logger.Warn().Str("zone_file", path).Int("line", line).Str("type", dns.TypeToString[rr.Header().Rrtype]).Msg("Skipping the apex record, the server answers with its own")
+			continue
+		default:
+			errs = append(errs, fmt.Errorf("%s:%d: unsupported record type %s", path, line, dns.TypeToString[rr.Header().Rrtype]))
+			continue
+		}
+		records[name] = entry
+	}
+	if err := parser.Err(); err != nil {
+		// parse errors already carry the line and column they occurred at
+		return nil, err
+	}
+
+	for name, entry := range records {
+		if hasCNAMEConflict(entry) {
+			errs = append(errs, fmt.Errorf("%s:%d: %s has a CNAME record and other records", path, cnameLines[name], name))
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return records, nil
+}
+
+// hasCNAMEConflict tells whether entry has a CNAME record along with other
+// records, which a CNAME can't have.
+func hasCNAMEConflict(entry hardcodedRecord) bool {
+	return len(entry.CNAME) > 0 && (len(entry.CNAME) > 1 || len(entry.A) > 0 || len(entry.AAAA) > 0 || len(entry.TXT) > 0 || len(entry.MX) > 0 || len(entry.SRV) > 0 || len(entry.CAA) > 0)
+}
+
+// zoneLineReader feeds a zone file to dns.ZoneParser one byte at a time, so
+// that it knows how far the parser has read: the first line holding an
+// entry, other than a directive or a comment, read since the previous record
+// is the line the next record starts at.
+type zoneLineReader struct {
+	reader *bytes.Reader
+	line   int
+	// entry is the line of the first entry read since entryLine was last
+	// called, 0 if none.
+	entry int
+	// started tells whether the current line has had other than blanks.
+	started bool
+}
+
+func (r *zoneLineReader) ReadByte() (byte, error) {
+	c, err := r.reader.ReadByte()
+	if err != nil {
+		return c, err
+	}
+
+	switch {
+	case c == '\n':
+		r.line++
+		r.started = false
+	case r.started, c == ' ', c == '\t', c == '\r':
+	default:
+		r.started = true
+		if c != ';' && c != '$' && r.entry == 0 {
+			r.entry = r.line
+		}
+	}
+
+	return c, nil
+}
+
+func (r *zoneLineReader) Read(p []byte) (int, error) {
+	for i := range p {
+		c, err := r.ReadByte()
+		if err != nil {
+			return i, err
+		}
+		p[i] = c
+	}
+
+	return len(p), nil
+}
+
+// entryLine returns the line the record last returned by the parser started
+// at, or 0 if the parser read no entry for it.
+func (r *zoneLineReader) entryLine() int {
+	entry := r.entry
+	r.entry = 0
+	return entry
+}
+
+// checkStaticRecords tells whether staticRecords can be merged with the
+// dynamic records: the names the server answers for itself, like the name
+// servers or the ACME challenges, can't be CNAMEs. Callers must hold
+// recordsMu.
+func (xip *Xip) checkStaticRecords(staticRecords map[string]hardcodedRecord) error {
+	challenge := fmt.Sprintf("_acme-challenge.%s.", xip.domain)
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(staticRecords)) {
+		if _, ok := xip.dynamicRecords[name]; (ok || name == challenge) && len(staticRecords[name].CNAME) > 0 {
+			errs = append(errs, fmt.Errorf("%s: %s has a CNAME record and records of the server", xip.zoneFile, name))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// mergeRecords adds every record of src to dst.
+func mergeRecords(dst map[string]hardcodedRecord, src map[string]hardcodedRecord) {
+	for name, records := range src {
+		entry := dst[name]
+		entry.A = append(entry.A, records.A...)
+		entry.AAAA = append(entry.AAAA, records.AAAA...)
+		entry.TXT = append(entry.TXT, records.TXT...)
+		entry.MX = append(entry.MX, records.MX...)
+		entry.CNAME = append(entry.CNAME, records.CNAME...)
+		entry.SRV = append(entry.SRV, records.SRV...)
+		entry.CAA = append(entry.CAA, records.CAA...)
+		dst[name] = entry
+	}
+}